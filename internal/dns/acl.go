@@ -0,0 +1,105 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// access is what a client is allowed to do
+type access int
+
+const (
+	accessRefused access = iota // Every query is answered with REFUSED
+	accessForward               // Queries are forwarded upstream, never spoofed
+	accessFull                  // Spoofing and forwarding
+)
+
+// ParseCIDRs parses a comma-separated list of CIDRs; bare IPs are treated as
+// single-host networks
+func ParseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", field)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, network)
+	}
+	return nets, nil
+}
+
+// LoadCIDRs reads CIDRs or IPs from a file, one or more comma-separated per
+// line; "#" starts a comment. Useful for ranges exported per ASN.
+func LoadCIDRs(path string) ([]*net.IPNet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var nets []*net.IPNet
+	for i, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		parsed, err := ParseCIDRs(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+		nets = append(nets, parsed...)
+	}
+	return nets, nil
+}
+
+// containsIP reports whether ip is inside any of the networks
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the source address of the query
+func clientIP(w dns.ResponseWriter) net.IP {
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// clientAccess decides what the client may do. DenyClients is checked first,
+// then SpoofClients and ForwardClients. A client matching none of them gets
+// full access if both allow lists are empty and is refused otherwise.
+func (s *Server) clientAccess(ip net.IP) access {
+	switch {
+	case containsIP(s.config.DenyClients, ip):
+		return accessRefused
+	case containsIP(s.config.SpoofClients, ip):
+		return accessFull
+	case containsIP(s.config.ForwardClients, ip):
+		return accessForward
+	case len(s.config.SpoofClients) == 0 && len(s.config.ForwardClients) == 0:
+		return accessFull
+	}
+	return accessRefused
+}
@@ -0,0 +1,275 @@
+package dns
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+
+	"DnsSpoofer/internal/match"
+)
+
+// hostsLocalNames are the loopback names found at the top of most hosts files,
+// which are never blocked
+var hostsLocalNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// Blocklist is a list of blocked names loaded from a hosts or adblock file
+type Blocklist struct {
+	Name     string   // Name used in logs and stats (the file name by default)
+	Path     string   // File the list was loaded from
+	Disabled bool     // Loaded but not applied until enabled with SetBlocklistEnabled
+	Block    []string // Blocked name patterns (see package match)
+	Allow    []string // Patterns never blocked by any list (adblock @@ exceptions)
+}
+
+// LoadBlocklist loads "[name=]path", a file in hosts format ("0.0.0.0 ads.example.com"),
+// adblock format ("||ads.example.com^", "@@||ok.example.com^") or one name per line.
+// Hosts entries and bare names block only the name itself, adblock rules the
+// name and its subdomains. Unsupported lines (cosmetic rules, modifiers) are skipped.
+// Text before the first "=" is a name only if it has no path separator, so
+// paths like "/lists/v=2/hosts" load as is ("./v=2" for a relative one).
+func LoadBlocklist(spec string) (Blocklist, error) {
+	list := Blocklist{Path: spec}
+	if name, path, ok := strings.Cut(spec, "="); ok && !strings.ContainsAny(name, `/\`) {
+		list.Name, list.Path = strings.TrimSpace(name), path
+	}
+	list.Path = strings.TrimSpace(list.Path)
+	if list.Name == "" {
+		list.Name = filepath.Base(list.Path)
+	}
+
+	f, err := os.Open(list.Path)
+	if err != nil {
+		return Blocklist{}, fmt.Errorf("blocklist %s: %w", list.Name, err)
+	}
+	defer f.Close()
+
+	skipped := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		patterns, allow, ok := parseBlocklistLine(scanner.Text())
+		switch {
+		case !ok:
+			skipped++
+		case allow:
+			list.Allow = append(list.Allow, patterns...)
+		default:
+			list.Block = append(list.Block, patterns...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Blocklist{}, fmt.Errorf("blocklist %s: %w", list.Name, err)
+	}
+	if skipped > 0 {
+		log.Printf("[DNS] Blocklist %s: skipped %d unsupported lines", list.Name, skipped)
+	}
+	return list, nil
+}
+
+// parseBlocklistLine returns the patterns of one list line and whether they
+// are exceptions. Comments and blank lines have no patterns; ok is false for
+// lines that cannot be used for DNS blocking.
+func parseBlocklistLine(line string) (patterns []string, allow, ok bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "[") {
+		return nil, false, true
+	}
+
+	// Adblock syntax: ||name^ blocks the name and its subdomains
+	if rest, ok := strings.CutPrefix(line, "@@"); ok {
+		line, allow = rest, true
+	}
+	if rest, ok := strings.CutPrefix(line, "||"); ok {
+		name, ok := strings.CutSuffix(strings.TrimSuffix(rest, "|"), "^")
+		if !ok || !validBlockName(name) {
+			return nil, false, false
+		}
+		return []string{strings.ToLower(name)}, allow, true
+	}
+	if allow {
+		return nil, false, false
+	}
+
+	// Hosts syntax: an address followed by names, or a bare name. Comments
+	// start after whitespace; "##" inside a word is an adblock cosmetic rule.
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		if j := strings.Index(line[i:], "#"); j >= 0 {
+			line = line[:i+j]
+		}
+	}
+	fields := strings.Fields(line)
+	if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+		fields = fields[1:]
+	}
+	for _, name := range fields {
+		name = strings.ToLower(name)
+		if hostsLocalNames[name] {
+			continue
+		}
+		if strings.Contains(name, "*") || !validBlockName(name) {
+			return nil, false, false
+		}
+		patterns = append(patterns, "="+name)
+	}
+	return patterns, false, true
+}
+
+// validBlockName reports whether name can be used as a block pattern: a
+// domain name, optionally with * wildcards
+func validBlockName(name string) bool {
+	if name == "" || strings.ContainsAny(name, "/$|^?[#") {
+		return false
+	}
+	_, ok := dns.IsDomainName(strings.ReplaceAll(name, "*", "x"))
+	return ok
+}
+
+// blocklist is a loaded Blocklist with its counters
+type blocklist struct {
+	name    string
+	path    string
+	entries int
+	enabled atomic.Bool
+	block   *match.Matcher[struct{}]
+	allow   *match.Matcher[struct{}]
+	blocked atomic.Uint64 // Queries blocked by this list
+}
+
+// newBlocklists builds the matchers of the lists. Invalid patterns are logged and skipped.
+func newBlocklists(lists []Blocklist) []*blocklist {
+	out := make([]*blocklist, 0, len(lists))
+	for _, l := range lists {
+		b := &blocklist{
+			name:  l.Name,
+			path:  l.Path,
+			block: match.New[struct{}](),
+			allow: newPatternSet(l.Allow),
+		}
+		for _, pattern := range l.Block {
+			if err := b.block.Add(pattern, struct{}{}); err != nil {
+				log.Printf("[DNS] Blocklist %s: ignoring pattern: %v", l.Name, err)
+			}
+		}
+		b.entries = b.block.Len()
+		b.enabled.Store(!l.Disabled)
+		out = append(out, b)
+	}
+	return out
+}
+
+// newPatternSet builds a matcher of patterns without values. Invalid
+// patterns are logged and skipped.
+func newPatternSet(patterns []string) *match.Matcher[struct{}] {
+	m := match.New[struct{}]()
+	for _, pattern := range patterns {
+		if strings.TrimSpace(pattern) == "" {
+			continue
+		}
+		if err := m.Add(pattern, struct{}{}); err != nil {
+			log.Printf("[DNS] Ignoring allowlist pattern: %v", err)
+		}
+	}
+	return m
+}
+
+// blockingList returns the first enabled list blocking name, or nil if no
+// list does or the name is allowlisted (by Config.BlocklistAllow or an
+// exception in any enabled list)
+func (s *Server) blockingList(name string) *blocklist {
+	var found *blocklist
+	for _, b := range s.blocklists {
+		if !b.enabled.Load() {
+			continue
+		}
+		if _, ok := b.allow.Match(name); ok {
+			return nil
+		}
+		if _, ok := b.block.Match(name); ok && found == nil {
+			found = b
+		}
+	}
+	if found == nil {
+		return nil
+	}
+	if _, ok := s.blockAllow.Match(name); ok {
+		return nil
+	}
+	return found
+}
+
+// blockReply answers queries for blocked names with the blocklist action, or
+// returns nil if the query is not blocked. Names with a rule or spoof pattern
+// are never blocked.
+func (s *Server) blockReply(r *dns.Msg) *dns.Msg {
+	if len(s.blocklists) == 0 {
+		return nil
+	}
+	q := r.Question[0]
+	if q.Qclass != dns.ClassINET || s.matchRule(q.Name) != nil {
+		return nil
+	}
+	list := s.blockingList(q.Name)
+	if list == nil {
+		return nil
+	}
+	list.blocked.Add(1)
+	log.Printf("[DNS] Blocked %s (type %s) by blocklist %s", q.Name, dns.TypeToString[q.Qtype], list.name)
+	return ruleReply(r, s.blockRule)
+}
+
+// SetBlocklistEnabled enables or disables the named blocklist, returning
+// false if there is no such list
+func (s *Server) SetBlocklistEnabled(name string, enabled bool) bool {
+	for _, b := range s.blocklists {
+		if b.name == name {
+			b.enabled.Store(enabled)
+			log.Printf("[DNS] Blocklist %s enabled: %v", name, enabled)
+			return true
+		}
+	}
+	return false
+}
+
+// BlocklistStats holds the counters of one blocklist
+type BlocklistStats struct {
+	Name    string
+	Path    string
+	Enabled bool
+	Entries int    // Patterns loaded from the list
+	Blocked uint64 // Queries blocked by the list
+}
+
+// BlocklistStats returns the counters of each blocklist
+func (s *Server) BlocklistStats() []BlocklistStats {
+	stats := make([]BlocklistStats, 0, len(s.blocklists))
+	for _, b := range s.blocklists {
+		stats = append(stats, BlocklistStats{
+			Name:    b.name,
+			Path:    b.path,
+			Enabled: b.enabled.Load(),
+			Entries: b.entries,
+			Blocked: b.blocked.Load(),
+		})
+	}
+	return stats
+}
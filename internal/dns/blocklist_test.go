@@ -0,0 +1,40 @@
+package dns
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadBlocklistSpec(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "v=2", "hosts.txt")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("0.0.0.0 ads.example.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(dir)
+
+	tests := []struct {
+		spec, name, path string
+	}{
+		{path, "hosts.txt", path},
+		{"ads=" + path, "ads", path},
+		{" ads = " + path, "ads", path},
+		{"./v=2/hosts.txt", "hosts.txt", "./v=2/hosts.txt"},
+		{"ads=./v=2/hosts.txt", "ads", "./v=2/hosts.txt"},
+	}
+	for _, tt := range tests {
+		list, err := LoadBlocklist(tt.spec)
+		if err != nil {
+			t.Errorf("LoadBlocklist(%q): %v", tt.spec, err)
+			continue
+		}
+		if list.Name != tt.name || list.Path != tt.path || len(list.Block) != 1 {
+			t.Errorf("LoadBlocklist(%q) = name %q, path %q, %d patterns; want %q, %q, 1",
+				tt.spec, list.Name, list.Path, len(list.Block), tt.name, tt.path)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package dns
+
+import (
+	"log"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"DnsSpoofer/internal/match"
+)
+
+// Canary names clients check before bypassing the network's resolver
+var (
+	// Firefox disables its default DoH if this name does not resolve
+	// (https://support.mozilla.org/kb/canary-domain-use-application-dnsnet)
+	firefoxCanaries = []string{"=use-application-dns.net"}
+	// iCloud Private Relay is turned off for the network if these names do not
+	// resolve (https://developer.apple.com/support/prepare-your-network-for-icloud-private-relay)
+	privateRelayCanaries = []string{"=mask.icloud.com", "=mask-h2.icloud.com"}
+)
+
+// defaultDoHResolvers are the hostnames of well-known public DoH/DoT
+// resolvers. Resolvers used by IP address (e.g., https://1.1.1.1) cannot be
+// blocked by DNS.
+var defaultDoHResolvers = []string{
+	// Google
+	"=dns.google", "=dns.google.com", "=dns64.dns.google",
+	// Cloudflare (mozilla., chrome., security., family., one.one.one.one)
+	"cloudflare-dns.com", "=one.one.one.one", "=1dot1dot1dot1.cloudflare-dns.com",
+	// Quad9
+	"=dns.quad9.net", "=dns9.quad9.net", "=dns10.quad9.net", "=dns11.quad9.net", "=dns12.quad9.net",
+	// OpenDNS / Cisco Umbrella
+	"=doh.opendns.com", "=doh.familyshield.opendns.com", "=doh.umbrella.com",
+	// AdGuard
+	"=dns.adguard.com", "=dns-family.adguard.com", "=dns-unfiltered.adguard.com",
+	"=dns.adguard-dns.com", "=family.adguard-dns.com", "=unfiltered.adguard-dns.com",
+	// NextDNS (per-profile subdomains)
+	"dns.nextdns.io",
+	// CleanBrowsing
+	"doh.cleanbrowsing.org",
+	// Control D
+	"=dns.controld.com", "=freedns.controld.com",
+	// Mullvad
+	"dns.mullvad.net",
+	// Others
+	"=doh.dns.sb", "=dns.alidns.com", "=doh.pub", "=dns.pub", "=doh.360.cn",
+	"=doh.xfinity.com", "=dns.switch.ch", "=odvr.nic.cz", "=dns.digitale-gesellschaft.ch",
+	"=dns.twnic.tw", "=doh.libredns.gr",
+}
+
+// bypassPolicy is how one kind of DoH bypass is answered
+type bypassPolicy struct {
+	reason string // Logged with the query
+	rule   *rule
+}
+
+// newBypassRules builds the DoH bypass countermeasures: canaries are answered
+// with NXDOMAIN, resolver hostnames (the defaults and extra) are sinkholed.
+// Extra patterns may be exceptions ("!dns.example") to keep a resolver working.
+func newBypassRules(extra []string) *match.Matcher[*bypassPolicy] {
+	m := match.New[*bypassPolicy]()
+	add := func(patterns []string, policy *bypassPolicy) {
+		for _, pattern := range patterns {
+			if strings.TrimSpace(pattern) == "" {
+				continue
+			}
+			if err := m.Add(pattern, policy); err != nil {
+				log.Printf("[DNS] Ignoring DoH resolver pattern: %v", err)
+			}
+		}
+	}
+	nxdomain := &rule{action: ActionNXDomain}
+	add(firefoxCanaries, &bypassPolicy{reason: "Firefox DoH canary", rule: nxdomain})
+	add(privateRelayCanaries, &bypassPolicy{reason: "iCloud Private Relay canary", rule: nxdomain})
+	resolver := &bypassPolicy{reason: "DoH/DoT resolver", rule: &rule{action: ActionSinkhole, addrs: sinkholeAddrs}}
+	add(extra, resolver)
+	add(defaultDoHResolvers, resolver)
+	return m
+}
+
+// bypassReply answers queries that let clients bypass our resolver (DoH
+// canaries and public DoH/DoT resolvers) when Config.BlockDoH is set, or
+// returns nil. Names with a rule or spoof pattern are left to it.
+func (s *Server) bypassReply(r *dns.Msg) *dns.Msg {
+	if s.bypass == nil {
+		return nil
+	}
+	q := r.Question[0]
+	if q.Qclass != dns.ClassINET || s.matchRule(q.Name) != nil {
+		return nil
+	}
+	policy, ok := s.bypass.Match(q.Name)
+	if !ok {
+		return nil
+	}
+	log.Printf("[DNS] %s %s (type %s) -> %s", policy.reason, q.Name, dns.TypeToString[q.Qtype], policy.rule.action)
+	return ruleReply(r, policy.rule)
+}
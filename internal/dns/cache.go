@@ -0,0 +1,296 @@
+package dns
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	maxCacheTTL    = 24 * time.Hour // Upper bound for positive answers
+	maxNegativeTTL = 3 * time.Hour  // Upper bound for NXDOMAIN/NODATA (RFC 2308 section 5)
+	staleAnswerTTL = 30             // TTL of records served stale, in seconds (RFC 8767 section 4)
+	prefetchRatio  = 10             // Prefetch when less than 1/prefetchRatio of the TTL remains
+)
+
+// cacheStatus is the result of a cache lookup
+type cacheStatus int
+
+const (
+	cacheMiss     cacheStatus = iota // Not cached or expired beyond the stale window
+	cacheFresh                       // Within TTL
+	cachePrefetch                    // Within TTL, popular and about to expire: refresh in background
+	cacheStale                       // Expired but within the serve-stale window
+)
+
+// cacheKey identifies a cacheable query
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	do     bool   // DNSSEC OK: answers with and without signatures differ
+	cd     bool   // Checking Disabled
+	ecs    string // EDNS Client Subnet sent upstream: answers may differ per subnet
+}
+
+// newCacheKey returns the cache key for r, or false if r is not cacheable
+// (only single-question standard queries are cached)
+func newCacheKey(r *dns.Msg) (cacheKey, bool) {
+	if r.Opcode != dns.OpcodeQuery || len(r.Question) != 1 {
+		return cacheKey{}, false
+	}
+	q := r.Question[0]
+	key := cacheKey{
+		name:   strings.ToLower(q.Name),
+		qtype:  q.Qtype,
+		qclass: q.Qclass,
+		cd:     r.CheckingDisabled,
+	}
+	if opt := r.IsEdns0(); opt != nil {
+		key.do = opt.Do()
+	}
+	if ecs := findECS(r); ecs != nil {
+		key.ecs = fmt.Sprintf("%s/%d", ecs.Address, ecs.SourceNetmask)
+	}
+	return key, true
+}
+
+// cacheEntry is a cached response
+type cacheEntry struct {
+	key     cacheKey
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+	hits    int // Hits since the entry was stored
+}
+
+// cache is a size-bounded LRU cache of upstream responses honoring record
+// TTLs, including negative answers (RFC 2308). Expired entries are kept for
+// serveStale so they can be answered when upstreams fail (RFC 8767).
+type cache struct {
+	mu           sync.Mutex
+	size         int
+	serveStale   time.Duration // How long past expiry entries may be served stale
+	prefetchHits int           // Hits needed before an entry is prefetched (0 disables)
+	entries      map[cacheKey]*list.Element
+	lru          *list.List // Front is most recently used
+	hits         atomic.Uint64
+	misses       atomic.Uint64
+	staleServed  atomic.Uint64
+	prefetches   atomic.Uint64
+}
+
+// newCache creates a cache holding at most size responses
+func newCache(size int, serveStale time.Duration, prefetchHits int) *cache {
+	return &cache{
+		size:         size,
+		serveStale:   serveStale,
+		prefetchHits: prefetchHits,
+		entries:      make(map[cacheKey]*list.Element),
+		lru:          list.New(),
+	}
+}
+
+// get returns a copy of the cached response with TTLs reduced by the time
+// spent in the cache. Stale responses get staleAnswerTTL on all records.
+func (c *cache) get(key cacheKey, now time.Time) (*dns.Msg, cacheStatus) {
+	c.mu.Lock()
+	elem, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		c.misses.Add(1)
+		return nil, cacheMiss
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !now.Before(entry.expires.Add(c.serveStale)) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		c.mu.Unlock()
+		c.misses.Add(1)
+		return nil, cacheMiss
+	}
+	c.lru.MoveToFront(elem)
+	entry.hits++
+	hits := entry.hits
+	c.mu.Unlock()
+
+	msg := entry.msg.Copy()
+	if !now.Before(entry.expires) {
+		setTTL(msg, staleAnswerTTL)
+		return msg, cacheStale
+	}
+
+	c.hits.Add(1)
+	decrementTTL(msg, uint32(now.Sub(entry.stored)/time.Second))
+	ttl := entry.expires.Sub(entry.stored)
+	if c.prefetchHits > 0 && hits >= c.prefetchHits && entry.expires.Sub(now) < ttl/prefetchRatio {
+		c.prefetches.Add(1)
+		return msg, cachePrefetch
+	}
+	return msg, cacheFresh
+}
+
+// set stores a copy of msg if it is cacheable, evicting the least recently
+// used entry when the cache is full
+func (c *cache) set(key cacheKey, msg *dns.Msg, now time.Time) {
+	ttl, ok := cacheTTL(msg)
+	if !ok {
+		return
+	}
+
+	entry := &cacheEntry{
+		key:     key,
+		msg:     msg.Copy(),
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// cacheTTL returns how long msg may be cached: the smallest answer TTL for
+// positive responses, and the SOA TTL bounded by its MINIMUM field for
+// NXDOMAIN/NODATA (RFC 2308 section 5). Responses without an SOA,
+// truncated responses and failures are not cached.
+func cacheTTL(msg *dns.Msg) (time.Duration, bool) {
+	if msg.Truncated {
+		return 0, false
+	}
+
+	switch {
+	case msg.Rcode == dns.RcodeSuccess && len(msg.Answer) > 0:
+		ttl := msg.Answer[0].Header().Ttl
+		for _, rr := range msg.Answer[1:] {
+			ttl = min(ttl, rr.Header().Ttl)
+		}
+		if ttl == 0 {
+			return 0, false
+		}
+		return min(time.Duration(ttl)*time.Second, maxCacheTTL), true
+
+	case msg.Rcode == dns.RcodeSuccess || msg.Rcode == dns.RcodeNameError:
+		for _, rr := range msg.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl := min(soa.Hdr.Ttl, soa.Minttl)
+				if ttl == 0 {
+					return 0, false
+				}
+				return min(time.Duration(ttl)*time.Second, maxNegativeTTL), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// decrementTTL lowers the TTL of all records by elapsed seconds
+func decrementTTL(msg *dns.Msg, elapsed uint32) {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if hdr.Ttl > elapsed {
+				hdr.Ttl -= elapsed
+			} else {
+				hdr.Ttl = 0
+			}
+		}
+	}
+}
+
+// clampTTL raises record TTLs below lo to lo and lowers those above hi to hi
+// (0 disables a bound), so clamped answers are also cached accordingly
+func clampTTL(msg *dns.Msg, lo, hi uint32) {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if lo > 0 && hdr.Ttl < lo {
+				hdr.Ttl = lo
+			}
+			if hi > 0 && hdr.Ttl > hi {
+				hdr.Ttl = hi
+			}
+		}
+	}
+}
+
+// setTTL sets the TTL of all records to ttl seconds
+func setTTL(msg *dns.Msg, ttl uint32) {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if hdr := rr.Header(); hdr.Rrtype != dns.TypeOPT {
+				hdr.Ttl = ttl
+			}
+		}
+	}
+}
+
+// Len returns the number of cached responses
+func (c *cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// flightCall is an upstream query in progress
+type flightCall struct {
+	done chan struct{}
+	resp *dns.Msg
+	err  error
+}
+
+// flightGroup coalesces concurrent identical upstream queries so that
+// a single upstream request serves all of them
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[cacheKey]*flightCall
+}
+
+// do runs fn once per key at a time; concurrent callers with the same key
+// wait for and share its result. Callers must not modify the returned message.
+func (g *flightGroup) do(key cacheKey, fn func() (*dns.Msg, error)) (*dns.Msg, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[cacheKey]*flightCall)
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-call.done
+		return call.resp, call.err
+	}
+	call := &flightCall{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	call.resp, call.err = fn()
+	close(call.done)
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+
+	return call.resp, call.err
+}
@@ -0,0 +1,172 @@
+package dns
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	maxCNAMEChain = 16        // Longest CNAME chain followed in an answer
+	aliasTTL      = time.Hour // How long the proxy accepts an alias after it was answered
+	maxAliases    = 10000     // Maximum number of remembered aliases
+)
+
+// aliasSet remembers names whose CNAME chain entered a spoofed name, so the
+// proxy accepts them as SNI/Host
+type aliasSet struct {
+	mu    sync.Mutex
+	names map[string]alias // Lowercase name without trailing dot
+}
+
+// alias is a remembered name and the spoofed name its chain entered
+type alias struct {
+	via    string // Lowercase spoofed name without trailing dot
+	expiry time.Time
+}
+
+// add remembers name as an alias of the spoofed name via until now+aliasTTL.
+// When the set is full, expired names are dropped first; if it is still
+// full, name is not added.
+func (a *aliasSet) add(name, via string, now time.Time) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.names == nil {
+		a.names = make(map[string]alias)
+	}
+	if _, ok := a.names[name]; !ok && len(a.names) >= maxAliases {
+		for n, al := range a.names {
+			if now.After(al.expiry) {
+				delete(a.names, n)
+			}
+		}
+		if len(a.names) >= maxAliases {
+			return
+		}
+	}
+	a.names[name] = alias{
+		via:    strings.TrimSuffix(strings.ToLower(via), "."),
+		expiry: now.Add(aliasTTL),
+	}
+}
+
+// lookup returns the spoofed name an unexpired alias was answered through
+func (a *aliasSet) lookup(name string, now time.Time) (string, bool) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	al, ok := a.names[name]
+	if !ok || !now.Before(al.expiry) {
+		return "", false
+	}
+	return al.via, true
+}
+
+// spoofChain rewrites a forwarded answer whose CNAME chain enters a spoofed
+// name: the CNAMEs are kept and the records of the last name in the chain are
+// replaced by the spoof addresses of the first spoofed name (NODATA for
+// HTTPS/SVCB). The aliases before the spoofed name are remembered for the
+// proxy together with that name, which the proxy connects to instead of
+// re-resolving the alias. Names with a rule (e.g., forward) and chains that
+// reach a non-spoof rule first are left to it. Returns false if the answer
+// was left unchanged.
+func (s *Server) spoofChain(r, resp *dns.Msg) bool {
+	q := r.Question[0]
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA, dns.TypeHTTPS, dns.TypeSVCB:
+	default:
+		return false
+	}
+	if resp.Rcode != dns.RcodeSuccess || s.matchRule(q.Name) != nil {
+		return false
+	}
+
+	var chain []dns.RR
+	var aliases []string
+	var spoofed *rule
+	target := q.Name
+	for len(chain) < maxCNAMEChain && spoofed == nil {
+		cname := findCNAME(resp.Answer, target)
+		if cname == nil {
+			break
+		}
+		aliases = append(aliases, target)
+		chain = append(chain, cname)
+		target = cname.Target
+		if rule := s.matchRule(target); rule != nil {
+			if rule.action != ActionSpoof {
+				return false // Left to the rule of a name in the chain
+			}
+			spoofed = rule
+		}
+	}
+	if spoofed == nil {
+		return false
+	}
+	via := target
+
+	// Keep the rest of the chain behind the spoofed name, e.g. into a CDN
+	for len(chain) < maxCNAMEChain {
+		cname := findCNAME(resp.Answer, target)
+		if cname == nil {
+			break
+		}
+		chain = append(chain, cname)
+		target = cname.Target
+	}
+
+	resp.Answer = chain
+	resp.Ns = nil
+	ips := spoofAddresses(resp, q.Qtype, target, spoofed.addrs, spoofed.answerTTL())
+	if len(ips) == 0 {
+		resp.Ns = append(resp.Ns, spoofed.soa(target))
+	}
+
+	now := time.Now()
+	for _, alias := range aliases {
+		s.aliases.add(alias, via, now)
+	}
+	log.Printf("[DNS] Spoofing %s (type %s) via CNAME %s -> %v", q.Name, dns.TypeToString[q.Qtype], via, ips)
+	return true
+}
+
+// spoofAddresses appends A or AAAA records of owner with the spoof addresses
+// and TTL to the answer and returns the addresses. The answer is no longer DNSSEC-validated.
+func spoofAddresses(resp *dns.Msg, qtype uint16, owner string, addrs *spoofAddrs, ttl uint32) []net.IP {
+	resp.AuthenticatedData = false
+	var ips []net.IP
+	switch qtype {
+	case dns.TypeA:
+		ips = addrs.rotate(addrs.v4)
+		for _, ip := range ips {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: owner, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+				A:   ip,
+			})
+		}
+	case dns.TypeAAAA:
+		ips = addrs.rotate(addrs.v6)
+		for _, ip := range ips {
+			resp.Answer = append(resp.Answer, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: owner, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl},
+				AAAA: ip,
+			})
+		}
+	}
+	return ips
+}
+
+// findCNAME returns the CNAME record owned by name in rrs, or nil
+func findCNAME(rrs []dns.RR, name string) *dns.CNAME {
+	for _, rr := range rrs {
+		if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+			return cname
+		}
+	}
+	return nil
+}
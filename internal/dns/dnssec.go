@@ -0,0 +1,800 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnssecState is the security status of validated data (RFC 4035 section 4.3).
+// Bogus data is reported as an error wrapping errBogus instead.
+type dnssecState int
+
+const (
+	dnssecInsecure dnssecState = iota // Provably unsigned: answered without AD
+	dnssecSecure                      // Chain of trust from the root: answered with AD
+)
+
+// errBogus marks validation failures of signed data (as opposed to lookup errors)
+var errBogus = errors.New("DNSSEC bogus")
+
+const (
+	maxKeyCacheTTL     = time.Hour        // Upper bound for caching validated zone keys
+	insecureKeyTTL     = 5 * time.Minute  // How long a zone stays known to be insecure
+	bogusKeyTTL        = 30 * time.Second // How long a zone with bogus keys is not looked up again
+	maxKeyCacheZones   = 10000            // The key cache is reset when it grows beyond this
+	maxNSEC3Iterations = 150              // NSEC3 with more iterations is treated as insecure (RFC 9276)
+)
+
+// rootTrustAnchors are the DS records of the root zone KSKs (IANA root-anchors.xml)
+var rootTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D", // KSK-2017
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16", // KSK-2024
+}
+
+// validator checks upstream answers against the chain of trust from the
+// root trust anchors, fetching DS and DNSKEY records through lookup
+type validator struct {
+	lookup   func(name string, qtype uint16) (*dns.Msg, error)
+	anchors  []*dns.DS
+	insecure []string // Negative trust anchors (RFC 7646): zones treated as insecure
+
+	mu   sync.Mutex
+	keys map[string]zoneKeys // Validation results of zone DNSKEY sets by zone
+}
+
+// zoneKeys is a cached validation result for a zone's keys
+type zoneKeys struct {
+	keys    []*dns.DNSKEY // Validated keys, nil if the zone is insecure
+	err     error         // Why the keys are bogus
+	expires time.Time
+}
+
+// newValidator creates a validator; names under the insecure zones (e.g.,
+// private forward zones the signed root denies) are never validated
+func newValidator(lookup func(name string, qtype uint16) (*dns.Msg, error), insecure []string) *validator {
+	v := &validator{lookup: lookup, keys: make(map[string]zoneKeys)}
+	for _, zone := range insecure {
+		v.insecure = append(v.insecure, dns.CanonicalName(zone))
+	}
+	for _, s := range rootTrustAnchors {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			panic("dns: invalid root trust anchor: " + err.Error())
+		}
+		v.anchors = append(v.anchors, rr.(*dns.DS))
+	}
+	return v
+}
+
+// negativeAnchor reports whether name is under a negative trust anchor
+func (v *validator) negativeAnchor(name string) bool {
+	for _, zone := range v.insecure {
+		if dns.IsSubDomain(zone, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// dnssecQuery returns a copy of r with DO and CD set, so upstreams send
+// signatures and leave validation (and bogus data) to us
+func dnssecQuery(r *dns.Msg) *dns.Msg {
+	q := r.Copy()
+	if opt := q.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		q.SetEdns0(ednsUDPSize, true)
+	}
+	q.CheckingDisabled = true
+	return q
+}
+
+// dnssecLookup resolves a DS or DNSKEY record set for the validator
+func (s *Server) dnssecLookup(name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	resp, err := s.resolve(dnssecQuery(m))
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("%s %s: %s", name, dns.TypeToString[qtype], dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
+
+// secureResponse validates the upstream response for request r in place:
+// AD is set only on secure data the client can see it for (RFC 6840 section
+// 5.7) and DNSSEC records are removed unless the client set DO. Clients
+// setting CD validate themselves and get the data unchecked. Returns an error
+// for bogus answers.
+func (s *Server) secureResponse(r, resp *dns.Msg) error {
+	do := r.IsEdns0() != nil && r.IsEdns0().Do()
+	resp.AuthenticatedData = false
+	resp.CheckingDisabled = r.CheckingDisabled
+
+	if !r.CheckingDisabled {
+		state, err := s.validator.validate(resp, time.Now())
+		if err != nil {
+			return err
+		}
+		resp.AuthenticatedData = state == dnssecSecure && (do || r.AuthenticatedData)
+	}
+	if !do {
+		qtype := r.Question[0].Qtype
+		resp.Answer = removeDNSSEC(resp.Answer, qtype)
+		resp.Ns = removeDNSSEC(resp.Ns, qtype)
+		resp.Extra = removeDNSSEC(resp.Extra, qtype)
+	}
+	return nil
+}
+
+// removeDNSSEC returns the records without signatures and denial records,
+// except those of the queried type (RFC 4035 section 3.2.1)
+func removeDNSSEC(rrs []dns.RR, qtype uint16) []dns.RR {
+	out := rrs[:0]
+	for _, rr := range rrs {
+		switch t := rr.Header().Rrtype; t {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			if t != qtype {
+				continue
+			}
+		}
+		out = append(out, rr)
+	}
+	return out
+}
+
+// validate returns the security status of an upstream response: every
+// record set in the answer and, for negative answers, the denial of
+// existence must be secure or provably insecure
+func (v *validator) validate(resp *dns.Msg, now time.Time) (dnssecState, error) {
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError || len(resp.Question) != 1 {
+		return dnssecInsecure, nil
+	}
+	q := resp.Question[0]
+
+	state := dnssecSecure
+	sets := rrsets(resp.Answer)
+	for _, set := range sets {
+		if set.synthesized(sets) {
+			continue
+		}
+		st, err := v.verifySet(set, resp.Ns, now)
+		if err != nil {
+			return st, err
+		}
+		state = min(state, st)
+	}
+
+	// Follow the CNAME chain to the name the answer or denial is about
+	name := q.Name
+	for range resp.Answer {
+		target := ""
+		for _, rr := range resp.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				target = cname.Target
+			}
+		}
+		if target == "" {
+			break
+		}
+		name = target
+	}
+	for _, rr := range resp.Answer {
+		if h := rr.Header(); strings.EqualFold(h.Name, name) && (h.Rrtype == q.Qtype || q.Qtype == dns.TypeANY) {
+			return state, nil
+		}
+	}
+
+	st, err := v.verifyDenial(resp.Ns, name, q.Qtype, resp.Rcode == dns.RcodeNameError, now)
+	return min(state, st), err
+}
+
+// verifySet validates one answer record set
+func (v *validator) verifySet(set *rrset, authority []dns.RR, now time.Time) (dnssecState, error) {
+	owner := set.rrs[0].Header().Name
+	if len(set.sigs) == 0 {
+		return v.provenInsecure(owner, now)
+	}
+	state, sig, err := v.verifySigned(set, now)
+	if err != nil || state == dnssecInsecure {
+		return state, err
+	}
+
+	// A wildcard expansion is only valid if the name itself does not exist
+	if labels := int(sig.Labels); labels < dns.CountLabel(owner) {
+		d, state, err := v.signedDenial(authority, now)
+		if err != nil || state == dnssecInsecure {
+			return state, err
+		}
+		if !d.noExactMatch(owner, labels) {
+			return state, fmt.Errorf("%w: wildcard answer for %s without proof that it does not exist", errBogus, owner)
+		}
+	}
+	return dnssecSecure, nil
+}
+
+// verifySigned checks the signatures of set with the keys of its signer zone
+func (v *validator) verifySigned(set *rrset, now time.Time) (dnssecState, *dns.RRSIG, error) {
+	owner := set.rrs[0].Header().Name
+	signer := set.sigs[0].SignerName
+	if !dns.IsSubDomain(signer, owner) {
+		return dnssecInsecure, nil, fmt.Errorf("%w: %s signed by unrelated zone %s", errBogus, owner, signer)
+	}
+
+	keys, err := v.zoneKeys(signer, now)
+	if err != nil || keys == nil {
+		return dnssecInsecure, nil, err
+	}
+	sig, err := verifyRRset(set, keys, now)
+	if err != nil {
+		return dnssecInsecure, nil, err
+	}
+	return dnssecSecure, sig, nil
+}
+
+// verifyDenial validates a NODATA or NXDOMAIN answer for name
+func (v *validator) verifyDenial(authority []dns.RR, name string, qtype uint16, nxdomain bool, now time.Time) (dnssecState, error) {
+	d, state, err := v.signedDenial(authority, now)
+	if err != nil || state == dnssecInsecure {
+		return state, err
+	}
+	if d.empty() {
+		return v.provenInsecure(name, now)
+	}
+	return d.proves(name, qtype, nxdomain)
+}
+
+// signedDenial validates the signed SOA, NSEC and NSEC3 records of an
+// authority section and returns the denial records. The result is empty if
+// none of them are signed.
+func (v *validator) signedDenial(authority []dns.RR, now time.Time) (denial, dnssecState, error) {
+	var d denial
+	for _, set := range rrsets(authority) {
+		t := set.rrs[0].Header().Rrtype
+		if len(set.sigs) == 0 || t != dns.TypeSOA && t != dns.TypeNSEC && t != dns.TypeNSEC3 {
+			continue
+		}
+		state, _, err := v.verifySigned(set, now)
+		if err != nil || state == dnssecInsecure {
+			return d, state, err
+		}
+		for _, rr := range set.rrs {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				d.nsec = append(d.nsec, rr)
+			case *dns.NSEC3:
+				d.nsec3 = append(d.nsec3, rr)
+			}
+		}
+	}
+	return d, dnssecSecure, nil
+}
+
+// provenInsecure checks that unsigned data at name is allowed: the closest
+// zone cut above it must be a delegation that its signed parent proves to
+// have no DS record, or the parent must itself be insecure (RFC 4035 section
+// 5.2). Names under a negative trust anchor are always insecure.
+func (v *validator) provenInsecure(name string, now time.Time) (dnssecState, error) {
+	if v.negativeAnchor(name) {
+		return dnssecInsecure, nil
+	}
+	for n := dns.CanonicalName(name); ; n = parentName(n) {
+		resp, err := v.lookup(n, dns.TypeDS)
+		if err != nil {
+			return dnssecInsecure, err
+		}
+
+		// Only the parent side can prove anything about a delegation at n,
+		// and records signed by n itself would make the chain circular
+		if set := findSet(resp.Answer, n, dns.TypeDS); set != nil && len(set.sigs) > 0 {
+			if !strictAncestor(set.sigs[0].SignerName, n) {
+				return dnssecInsecure, fmt.Errorf("%w: DS of %s signed by %s", errBogus, n, set.sigs[0].SignerName)
+			}
+			// n is a signed delegation: everything below must be signed
+			state, _, err := v.verifySigned(set, now)
+			if err != nil || state == dnssecInsecure {
+				return state, err
+			}
+			return dnssecInsecure, fmt.Errorf("%w: unsigned data at %s below signed delegation %s", errBogus, name, n)
+		}
+
+		d, state, err := v.signedDenial(signedAbove(resp.Ns, n), now)
+		if err != nil || state == dnssecInsecure {
+			return state, err
+		}
+		if !d.empty() {
+			if d.insecureDelegation(n) {
+				return dnssecInsecure, nil
+			}
+			return dnssecInsecure, fmt.Errorf("%w: unsigned data at %s, %s is not an insecure delegation", errBogus, name, n)
+		}
+
+		if n == "." {
+			return dnssecInsecure, fmt.Errorf("%w: no insecure delegation above %s", errBogus, name)
+		}
+	}
+}
+
+// zoneKeys returns the validated DNSKEYs of zone, or nil if the zone is
+// insecure (including zones under a negative trust anchor)
+func (v *validator) zoneKeys(zone string, now time.Time) ([]*dns.DNSKEY, error) {
+	zone = dns.CanonicalName(zone)
+	if v.negativeAnchor(zone) {
+		return nil, nil
+	}
+
+	v.mu.Lock()
+	zk, ok := v.keys[zone]
+	v.mu.Unlock()
+	if ok && now.Before(zk.expires) {
+		return zk.keys, zk.err
+	}
+
+	keys, ttl, err := v.fetchKeys(zone, now)
+	if err != nil && !errors.Is(err, errBogus) {
+		return nil, err // Lookup errors are not cached
+	}
+
+	v.mu.Lock()
+	if len(v.keys) >= maxKeyCacheZones {
+		clear(v.keys)
+	}
+	v.keys[zone] = zoneKeys{keys: keys, err: err, expires: now.Add(ttl)}
+	v.mu.Unlock()
+	return keys, err
+}
+
+// fetchKeys authenticates the DNSKEY set of zone: its DS records must be
+// signed by the parent (or be a root trust anchor) and match a key that signs
+// the set. Returns how long the result may be cached.
+func (v *validator) fetchKeys(zone string, now time.Time) ([]*dns.DNSKEY, time.Duration, error) {
+	ds := v.anchors
+	if zone != "." {
+		resp, err := v.lookup(zone, dns.TypeDS)
+		if err != nil {
+			return nil, 0, err
+		}
+		set := findSet(resp.Answer, zone, dns.TypeDS)
+		if set == nil || len(set.sigs) == 0 {
+			// No signed DS: fine if the parent proves the delegation insecure
+			_, err := v.provenInsecure(zone, now)
+			return nil, insecureKeyTTL, err
+		}
+		if !strictAncestor(set.sigs[0].SignerName, zone) {
+			return nil, bogusKeyTTL, fmt.Errorf("%w: DS of %s signed by %s", errBogus, zone, set.sigs[0].SignerName)
+		}
+		state, _, err := v.verifySigned(set, now)
+		if err != nil {
+			return nil, bogusKeyTTL, err
+		}
+		if state == dnssecInsecure {
+			return nil, insecureKeyTTL, nil
+		}
+		ds = ds[:0:0]
+		for _, rr := range set.rrs {
+			ds = append(ds, rr.(*dns.DS))
+		}
+	}
+
+	// Zones signed only with algorithms we do not implement are insecure
+	var supported []*dns.DS
+	for _, d := range ds {
+		if supportedAlgorithm(d.Algorithm) && supportedDigest(d.DigestType) {
+			supported = append(supported, d)
+		}
+	}
+	if len(supported) == 0 {
+		return nil, insecureKeyTTL, nil
+	}
+
+	resp, err := v.lookup(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, 0, err
+	}
+	set := findSet(resp.Answer, zone, dns.TypeDNSKEY)
+	if set == nil {
+		return nil, bogusKeyTTL, fmt.Errorf("%w: no DNSKEY for %s", errBogus, zone)
+	}
+
+	var keys, entry []*dns.DNSKEY
+	for _, rr := range set.rrs {
+		key := rr.(*dns.DNSKEY)
+		keys = append(keys, key)
+		for _, d := range supported {
+			if dsMatches(d, key) {
+				entry = append(entry, key)
+				break
+			}
+		}
+	}
+	if len(entry) == 0 {
+		return nil, bogusKeyTTL, fmt.Errorf("%w: no DNSKEY of %s matches its DS", errBogus, zone)
+	}
+	if _, err := verifyRRset(set, entry, now); err != nil {
+		return nil, bogusKeyTTL, err
+	}
+	return keys, min(time.Duration(set.rrs[0].Header().Ttl)*time.Second, maxKeyCacheTTL), nil
+}
+
+// verifyRRset checks that one of the set's signatures is currently valid and
+// made by one of keys
+func verifyRRset(set *rrset, keys []*dns.DNSKEY, now time.Time) (*dns.RRSIG, error) {
+	h := set.rrs[0].Header()
+	last := errors.New("no signature from a zone key")
+	for _, sig := range set.sigs {
+		if !sig.ValidityPeriod(now) {
+			last = errors.New("signature expired or not yet valid")
+			continue
+		}
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			if err := sig.Verify(key, set.rrs); err != nil {
+				last = err
+				continue
+			}
+			return sig, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s %s: %v", errBogus, h.Name, dns.TypeToString[h.Rrtype], last)
+}
+
+// dsMatches reports whether key is the one the DS record refers to
+func dsMatches(d *dns.DS, key *dns.DNSKEY) bool {
+	if key.KeyTag() != d.KeyTag || key.Algorithm != d.Algorithm {
+		return false
+	}
+	kd := key.ToDS(d.DigestType)
+	return kd != nil && strings.EqualFold(kd.Digest, d.Digest)
+}
+
+// supportedAlgorithm reports whether we can verify signatures of the algorithm
+func supportedAlgorithm(alg uint8) bool {
+	switch alg {
+	case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512,
+		dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+		return true
+	}
+	return false
+}
+
+// supportedDigest reports whether we can compute DS digests of the type
+func supportedDigest(digest uint8) bool {
+	return digest == dns.SHA1 || digest == dns.SHA256 || digest == dns.SHA384
+}
+
+// rrset is a record set with its signatures
+type rrset struct {
+	rrs  []dns.RR
+	sigs []*dns.RRSIG
+}
+
+// rrsets groups records by owner and type, attaching the RRSIGs that cover
+// them. Signatures without records are dropped.
+func rrsets(rrs []dns.RR) []*rrset {
+	type setKey struct {
+		name  string
+		rtype uint16
+	}
+	index := make(map[setKey]*rrset)
+	var order []*rrset
+	get := func(k setKey) *rrset {
+		set, ok := index[k]
+		if !ok {
+			set = new(rrset)
+			index[k] = set
+			order = append(order, set)
+		}
+		return set
+	}
+
+	for _, rr := range rrs {
+		h := rr.Header()
+		switch rr := rr.(type) {
+		case *dns.RRSIG:
+			set := get(setKey{strings.ToLower(h.Name), rr.TypeCovered})
+			set.sigs = append(set.sigs, rr)
+		case *dns.OPT:
+		default:
+			set := get(setKey{strings.ToLower(h.Name), h.Rrtype})
+			set.rrs = append(set.rrs, rr)
+		}
+	}
+
+	out := order[:0]
+	for _, set := range order {
+		if len(set.rrs) > 0 {
+			out = append(out, set)
+		}
+	}
+	return out
+}
+
+// findSet returns the record set of name and type, or nil
+func findSet(rrs []dns.RR, name string, rtype uint16) *rrset {
+	for _, set := range rrsets(rrs) {
+		if h := set.rrs[0].Header(); h.Rrtype == rtype && strings.EqualFold(h.Name, name) {
+			return set
+		}
+	}
+	return nil
+}
+
+// synthesized reports whether set is an unsigned CNAME synthesized from a
+// DNAME in the same answer, which is validated instead (RFC 6672 section 5.3.1)
+func (set *rrset) synthesized(sets []*rrset) bool {
+	h := set.rrs[0].Header()
+	if h.Rrtype != dns.TypeCNAME || len(set.sigs) > 0 {
+		return false
+	}
+	for _, other := range sets {
+		if dname, ok := other.rrs[0].(*dns.DNAME); ok && dns.IsSubDomain(dname.Hdr.Name, h.Name) && !strings.EqualFold(dname.Hdr.Name, h.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// denial holds the validated NSEC and NSEC3 records of a response
+type denial struct {
+	nsec  []*dns.NSEC
+	nsec3 []*dns.NSEC3
+}
+
+func (d denial) empty() bool {
+	return len(d.nsec) == 0 && len(d.nsec3) == 0
+}
+
+// proves checks that the records deny name (NXDOMAIN) or the type at name
+// (NODATA), including wildcard NODATA. NSEC3 opt-out spans make the answer
+// insecure (RFC 5155 section 9.2).
+func (d denial) proves(name string, qtype uint16, nxdomain bool) (dnssecState, error) {
+	if len(d.nsec) > 0 {
+		if nxdomain && d.nsecNameError(name) || !nxdomain && d.nsecNoData(name, qtype) {
+			return dnssecSecure, nil
+		}
+		return dnssecInsecure, fmt.Errorf("%w: NSEC records do not deny %s %s", errBogus, name, dns.TypeToString[qtype])
+	}
+
+	if !d.nsec3Usable() {
+		return dnssecInsecure, nil
+	}
+	if !nxdomain {
+		if n3 := d.nsec3Match(name); n3 != nil {
+			if hasType(n3.TypeBitMap, qtype) || hasType(n3.TypeBitMap, dns.TypeCNAME) {
+				return dnssecInsecure, fmt.Errorf("%w: NSEC3 shows %s %s exists", errBogus, name, dns.TypeToString[qtype])
+			}
+			return dnssecSecure, nil
+		}
+	}
+
+	ce, optOut, ok := d.nsec3ClosestEncloser(name)
+	switch {
+	case !ok:
+		return dnssecInsecure, fmt.Errorf("%w: no NSEC3 closest encloser proof for %s", errBogus, name)
+	case optOut:
+		return dnssecInsecure, nil
+	}
+	wildcard := "*." + ce
+	if ce == "." {
+		wildcard = "*."
+	}
+	if nxdomain && d.nsec3Cover(wildcard) != nil {
+		return dnssecSecure, nil
+	}
+	if n3 := d.nsec3Match(wildcard); !nxdomain && n3 != nil && !hasType(n3.TypeBitMap, qtype) && !hasType(n3.TypeBitMap, dns.TypeCNAME) {
+		return dnssecSecure, nil
+	}
+	return dnssecInsecure, fmt.Errorf("%w: NSEC3 records do not deny %s %s", errBogus, name, dns.TypeToString[qtype])
+}
+
+// insecureDelegation reports whether the records prove n to be a delegation
+// without DS record, or one covered by an NSEC3 opt-out span
+func (d denial) insecureDelegation(n string) bool {
+	delegation := func(types []uint16) bool {
+		return hasType(types, dns.TypeNS) && !hasType(types, dns.TypeDS) && !hasType(types, dns.TypeSOA)
+	}
+	for _, nsec := range d.nsec {
+		if strings.EqualFold(nsec.Hdr.Name, n) {
+			return delegation(nsec.TypeBitMap)
+		}
+	}
+	if len(d.nsec3) == 0 {
+		return false
+	}
+	if !d.nsec3Usable() {
+		return true
+	}
+	if n3 := d.nsec3Match(n); n3 != nil {
+		return delegation(n3.TypeBitMap)
+	}
+	_, optOut, ok := d.nsec3ClosestEncloser(n)
+	return ok && optOut
+}
+
+// noExactMatch reports whether the records prove that owner does not exist,
+// as required for an answer expanded from a wildcard with the given number
+// of labels (RFC 4035 section 5.3.4)
+func (d denial) noExactMatch(owner string, labels int) bool {
+	for _, nsec := range d.nsec {
+		if nsecCovers(nsec, owner) {
+			return true
+		}
+	}
+	return d.nsec3Cover(ancestorName(owner, labels+1)) != nil
+}
+
+// nsecNoData reports whether an NSEC record shows that name exists without
+// qtype, is an empty non-terminal, or is answered by a wildcard without qtype
+func (d denial) nsecNoData(name string, qtype uint16) bool {
+	for _, nsec := range d.nsec {
+		if strings.EqualFold(nsec.Hdr.Name, name) {
+			return !hasType(nsec.TypeBitMap, qtype) && !hasType(nsec.TypeBitMap, dns.TypeCNAME)
+		}
+	}
+	for _, nsec := range d.nsec {
+		if nsecCovers(nsec, name) && dns.IsSubDomain(name, nsec.NextDomain) {
+			return true // Empty non-terminal
+		}
+	}
+
+	for _, nsec := range d.nsec {
+		if !nsecCovers(nsec, name) {
+			continue
+		}
+		wildcard := "*." + closestEncloser(name, nsec)
+		for _, w := range d.nsec {
+			if strings.EqualFold(w.Hdr.Name, wildcard) {
+				return !hasType(w.TypeBitMap, qtype) && !hasType(w.TypeBitMap, dns.TypeCNAME)
+			}
+		}
+	}
+	return false
+}
+
+// nsecNameError reports whether NSEC records show that neither name nor a
+// wildcard at its closest encloser exist
+func (d denial) nsecNameError(name string) bool {
+	for _, nsec := range d.nsec {
+		if !nsecCovers(nsec, name) {
+			continue
+		}
+		wildcard := "*." + closestEncloser(name, nsec)
+		for _, w := range d.nsec {
+			if nsecCovers(w, wildcard) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nsec3Usable reports whether all NSEC3 records use parameters we accept
+func (d denial) nsec3Usable() bool {
+	for _, n3 := range d.nsec3 {
+		if n3.Hash != dns.SHA1 || n3.Iterations > maxNSEC3Iterations {
+			return false
+		}
+	}
+	return true
+}
+
+func (d denial) nsec3Match(name string) *dns.NSEC3 {
+	for _, n3 := range d.nsec3 {
+		if n3.Match(name) {
+			return n3
+		}
+	}
+	return nil
+}
+
+func (d denial) nsec3Cover(name string) *dns.NSEC3 {
+	for _, n3 := range d.nsec3 {
+		if n3.Cover(name) {
+			return n3
+		}
+	}
+	return nil
+}
+
+// nsec3ClosestEncloser finds the closest existing ancestor of name and checks
+// that the next closer name is covered (RFC 5155 section 8.3). optOut is set
+// if the covering record has the opt-out flag.
+func (d denial) nsec3ClosestEncloser(name string) (ce string, optOut, ok bool) {
+	for labels := dns.CountLabel(name) - 1; labels >= 0; labels-- {
+		ce = ancestorName(name, labels)
+		if d.nsec3Match(ce) == nil {
+			continue
+		}
+		cover := d.nsec3Cover(ancestorName(name, labels+1))
+		if cover == nil {
+			return "", false, false
+		}
+		return ce, cover.Flags&1 == 1, true
+	}
+	return "", false, false
+}
+
+// nsecCovers reports whether name falls strictly between the owner and next
+// name of an NSEC record in canonical order (RFC 4034 section 6.1)
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	// Last NSEC of the zone, next is the apex
+	return dns.IsSubDomain(next, name) && (canonicalCompare(owner, name) < 0 || canonicalCompare(name, next) < 0)
+}
+
+// closestEncloser returns the longest ancestor of name that an NSEC record
+// covering name proves to exist
+func closestEncloser(name string, nsec *dns.NSEC) string {
+	labels := max(dns.CompareDomainName(name, nsec.Hdr.Name), dns.CompareDomainName(name, nsec.NextDomain))
+	return ancestorName(name, labels)
+}
+
+// canonicalCompare orders domain names canonically: label by label from the
+// right, case-insensitive (RFC 4034 section 6.1)
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// ancestorName returns the ancestor of name with the given number of labels
+func ancestorName(name string, labels int) string {
+	name = dns.Fqdn(name)
+	idx := dns.Split(name)
+	if labels <= 0 || len(idx) == 0 {
+		return "."
+	}
+	if labels >= len(idx) {
+		return name
+	}
+	return name[idx[len(idx)-labels]:]
+}
+
+// strictAncestor reports whether zone is a proper ancestor of name
+func strictAncestor(zone, name string) bool {
+	return dns.IsSubDomain(zone, name) && dns.CountLabel(zone) < dns.CountLabel(name)
+}
+
+// signedAbove returns the records without signatures made by name itself or
+// its descendants, leaving those sets unsigned
+func signedAbove(rrs []dns.RR, name string) []dns.RR {
+	var out []dns.RR
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok && !strictAncestor(sig.SignerName, name) {
+			continue
+		}
+		out = append(out, rr)
+	}
+	return out
+}
+
+// parentName returns the name without its first label
+func parentName(name string) string {
+	return ancestorName(name, dns.CountLabel(name)-1)
+}
+
+func hasType(types []uint16, t uint16) bool {
+	for _, x := range types {
+		if x == t {
+			return true
+		}
+	}
+	return false
+}
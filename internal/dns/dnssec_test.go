@@ -0,0 +1,569 @@
+package dns
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testZone is a zone served by testResolver, signed with its own key unless
+// unsigned
+type testZone struct {
+	apex    string
+	signed  bool
+	nsec3   bool
+	optOut  bool          // NSEC3 opt-out: insecure delegations are left out of the chain
+	expired bool          // Signatures expired an hour ago
+	key     *dns.DNSKEY   // Key the parent's DS refers to
+	signer  *dns.DNSKEY   // Key the zone is signed with, normally key
+	priv    crypto.Signer // Private key of signer
+	data    map[string][]dns.RR
+	chain   []dns.RR // NSEC or NSEC3 records
+}
+
+// testResolver answers like a recursive resolver from a set of test zones,
+// always with DNSSEC records
+type testResolver struct {
+	t     testing.TB // Fails on signing errors
+	zones map[string]*testZone
+}
+
+// newTestResolver builds this hierarchy below a test root:
+//
+//	test.           signed, NSEC
+//	secure.test.    signed, NSEC: records, CNAMEs, a wildcard
+//	insecure.test.  insecure delegation (no DS)
+//	bad.test.       DS does not match the key the zone is signed with
+//	expired.test.   signatures expired
+//	nsec3.test.     signed, NSEC3
+//	optout.test.    signed, NSEC3 opt-out, insecure delegation child.optout.test.
+//	corp.internal.  unsigned private zone the root does not delegate
+func newTestResolver(t testing.TB) *testResolver {
+	tr := &testResolver{t: t, zones: make(map[string]*testZone)}
+	root := tr.zone(".", true)
+	test := tr.zone("test.", true)
+	secure := tr.zone("secure.test.", true,
+		"www.secure.test. 300 IN A 192.0.2.1",
+		"alias.secure.test. 300 IN CNAME www.secure.test.",
+		"out.secure.test. 300 IN CNAME www.insecure.test.",
+		"*.wild.secure.test. 300 IN A 192.0.2.9",
+		"wild.secure.test. 300 IN TXT \"wildcard parent\"",
+	)
+	insecure := tr.zone("insecure.test.", false, "www.insecure.test. 300 IN A 192.0.2.2")
+	bad := tr.zone("bad.test.", true, "www.bad.test. 300 IN A 192.0.2.3")
+	expired := tr.zone("expired.test.", true, "www.expired.test. 300 IN A 192.0.2.5")
+	expired.expired = true
+	n3 := tr.zone("nsec3.test.", true, "www.nsec3.test. 300 IN A 192.0.2.4")
+	n3.nsec3 = true
+	optOut := tr.zone("optout.test.", true,
+		"www.optout.test. 300 IN A 192.0.2.6",
+		"child.optout.test. 3600 IN NS ns.child.optout.test.",
+	)
+	optOut.nsec3, optOut.optOut = true, true
+	tr.zone("child.optout.test.", false, "www.child.optout.test. 300 IN A 192.0.2.8")
+	tr.zone("corp.internal.", false, "www.corp.internal. 300 IN A 10.0.0.1")
+
+	// bad.test. publishes and signs with a key its DS does not refer to
+	bad.signer, bad.priv = newTestKey(t, "bad.test.")
+	bad.data["bad.test."] = append(ofType(bad.data["bad.test."], dns.TypeSOA), ofType(bad.data["bad.test."], dns.TypeNS)...)
+	bad.add(bad.signer)
+
+	delegate := func(parent *testZone, children ...*testZone) {
+		for _, child := range children {
+			parent.add(testRR(t, child.apex+" 3600 IN NS ns."+child.apex))
+			if child.signed {
+				parent.add(child.key.ToDS(dns.SHA256))
+			}
+		}
+	}
+	delegate(root, test)
+	delegate(test, secure, insecure, bad, expired, n3, optOut)
+
+	for _, z := range tr.zones {
+		z.build()
+	}
+	return tr
+}
+
+func newTestKey(t testing.TB, zone string) (*dns.DNSKEY, crypto.Signer) {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatalf("generating key for %s: %v", zone, err)
+	}
+	return key, priv.(crypto.Signer)
+}
+
+func testRR(t testing.TB, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("invalid test record %q: %v", s, err)
+	}
+	return rr
+}
+
+// zone adds a zone with SOA, NS and the given records
+func (tr *testResolver) zone(apex string, signed bool, records ...string) *testZone {
+	z := &testZone{apex: apex, signed: signed, data: make(map[string][]dns.RR)}
+	if signed {
+		z.key, z.priv = newTestKey(tr.t, apex)
+		z.signer = z.key
+		z.add(z.key)
+	}
+	host := strings.TrimPrefix(apex, ".")
+	z.add(testRR(tr.t, apex+" 3600 IN SOA ns."+host+" host."+host+" 1 3600 600 86400 300"))
+	z.add(testRR(tr.t, apex+" 3600 IN NS ns."+host))
+	for _, r := range records {
+		z.add(testRR(tr.t, r))
+	}
+	tr.zones[apex] = z
+	return z
+}
+
+func (z *testZone) add(rr dns.RR) {
+	name := strings.ToLower(rr.Header().Name)
+	z.data[name] = append(z.data[name], rr)
+}
+
+// insecureDelegation reports whether name is a delegation without DS
+func (z *testZone) insecureDelegation(name string) bool {
+	rrs := z.data[name]
+	return name != z.apex && len(ofType(rrs, dns.TypeNS)) > 0 && len(ofType(rrs, dns.TypeDS)) == 0
+}
+
+// build creates the NSEC or NSEC3 chain of a signed zone
+func (z *testZone) build() {
+	if !z.signed {
+		return
+	}
+	var names []string
+	for name := range z.data {
+		if !z.optOut || !z.insecureDelegation(name) {
+			names = append(names, name)
+		}
+	}
+
+	bitmap := func(name string, extra ...uint16) []uint16 {
+		types := append([]uint16(nil), extra...)
+		for _, rr := range z.data[name] {
+			types = append(types, rr.Header().Rrtype)
+		}
+		if !z.insecureDelegation(name) {
+			types = append(types, dns.TypeRRSIG)
+		}
+		sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+		out := types[:0]
+		for i, t := range types {
+			if i == 0 || t != types[i-1] {
+				out = append(out, t)
+			}
+		}
+		return out
+	}
+
+	if !z.nsec3 {
+		sort.Slice(names, func(i, j int) bool { return canonicalCompare(names[i], names[j]) < 0 })
+		for i, name := range names {
+			z.chain = append(z.chain, &dns.NSEC{
+				Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+				NextDomain: names[(i+1)%len(names)],
+				TypeBitMap: bitmap(name, dns.TypeNSEC),
+			})
+		}
+		return
+	}
+
+	hashes := make(map[string]string)
+	for _, name := range names {
+		hashes[dns.HashName(name, dns.SHA1, 0, "")] = name
+	}
+	sorted := make([]string, 0, len(hashes))
+	for h := range hashes {
+		sorted = append(sorted, h)
+	}
+	sort.Strings(sorted)
+	var flags uint8
+	if z.optOut {
+		flags = 1
+	}
+	for i, h := range sorted {
+		z.chain = append(z.chain, &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: strings.ToLower(h) + "." + z.apex, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+			Hash:       dns.SHA1,
+			Flags:      flags,
+			HashLength: 20,
+			NextDomain: sorted[(i+1)%len(sorted)],
+			TypeBitMap: bitmap(hashes[h]),
+		})
+	}
+}
+
+// sign returns rrs with their RRSIG. For wildcard expansions, wildcard is
+// the wildcard owner the records were expanded from.
+func (z *testZone) sign(t testing.TB, rrs []dns.RR, wildcard string) []dns.RR {
+	t.Helper()
+	if !z.signed || len(rrs) == 0 {
+		return rrs
+	}
+	now := time.Now()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrs[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrs[0].Header().Ttl},
+		KeyTag:     z.signer.KeyTag(),
+		SignerName: z.apex,
+		Algorithm:  z.signer.Algorithm,
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		Expiration: uint32(now.Add(time.Hour).Unix()),
+	}
+	if z.expired {
+		sig.Inception = uint32(now.Add(-3 * time.Hour).Unix())
+		sig.Expiration = uint32(now.Add(-time.Hour).Unix())
+	}
+
+	signed := rrs
+	if wildcard != "" {
+		signed = make([]dns.RR, len(rrs))
+		for i, rr := range rrs {
+			signed[i] = dns.Copy(rr)
+			signed[i].Header().Name = wildcard
+		}
+	}
+	if err := sig.Sign(z.priv, signed); err != nil {
+		t.Fatalf("signing %s/%s: %v", rrs[0].Header().Name, dns.TypeToString[rrs[0].Header().Rrtype], err)
+	}
+	sig.Hdr.Name = rrs[0].Header().Name
+	return append(rrs, sig)
+}
+
+// proof returns the signed chain records matching one of the names (NODATA
+// and closest encloser) or covering one of them (NXDOMAIN and next closer)
+func (z *testZone) proof(t testing.TB, match, cover []string) []dns.RR {
+	var out []dns.RR
+	for _, rr := range z.chain {
+		ok := false
+		for _, name := range match {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				ok = ok || strings.EqualFold(rr.Hdr.Name, name)
+			case *dns.NSEC3:
+				ok = ok || rr.Match(name)
+			}
+		}
+		for _, name := range cover {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				ok = ok || nsecCovers(rr, name)
+			case *dns.NSEC3:
+				ok = ok || rr.Cover(name)
+			}
+		}
+		if ok {
+			out = append(out, z.sign(t, []dns.RR{rr}, "")...)
+		}
+	}
+	return out
+}
+
+// negative adds the signed SOA and the denial records to the authority section
+func (z *testZone) negative(t testing.TB, m *dns.Msg, match, cover []string) {
+	m.Ns = append(m.Ns, z.sign(t, ofType(z.data[z.apex], dns.TypeSOA), "")...)
+	m.Ns = append(m.Ns, z.proof(t, match, cover)...)
+}
+
+// zoneFor returns the zone answering name: the closest enclosing zone, but
+// the parent for DS records at a zone apex
+func (tr *testResolver) zoneFor(name string, qtype uint16) *testZone {
+	var best *testZone
+	for apex, z := range tr.zones {
+		if !dns.IsSubDomain(apex, name) || qtype == dns.TypeDS && apex == name && apex != "." {
+			continue
+		}
+		if best == nil || dns.CountLabel(apex) > dns.CountLabel(best.apex) {
+			best = z
+		}
+	}
+	return best
+}
+
+// resolve answers a query for name and qtype
+func (tr *testResolver) resolve(name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.Response = true
+	tr.answer(m, strings.ToLower(name), qtype, 0)
+	return m
+}
+
+func (tr *testResolver) answer(m *dns.Msg, name string, qtype uint16, depth int) {
+	z := tr.zoneFor(name, qtype)
+	if rrs, ok := z.data[name]; ok {
+		if set := ofType(rrs, qtype); len(set) > 0 {
+			m.Answer = append(m.Answer, z.sign(tr.t, set, "")...)
+			return
+		}
+		if set := ofType(rrs, dns.TypeCNAME); len(set) > 0 {
+			m.Answer = append(m.Answer, z.sign(tr.t, set, "")...)
+			if depth < maxCNAMEChain {
+				tr.answer(m, set[0].(*dns.CNAME).Target, qtype, depth+1)
+			}
+			return
+		}
+		// NODATA; an opt-out delegation is proven by its closest encloser
+		ce := parentName(name)
+		z.negative(tr.t, m, []string{name, ce}, []string{name})
+		return
+	}
+
+	// Find the closest encloser, then answer from its wildcard or deny
+	for labels := dns.CountLabel(name) - 1; labels >= 0; labels-- {
+		ce := ancestorName(name, labels)
+		if _, ok := z.data[ce]; !ok && ce != z.apex {
+			continue
+		}
+		nextCloser := ancestorName(name, labels+1)
+		wildcard := "*." + strings.TrimPrefix(ce, ".")
+		if ce == "." {
+			wildcard = "*."
+		}
+		if rrs, ok := z.data[wildcard]; ok {
+			if set := ofType(rrs, qtype); len(set) > 0 {
+				expanded := make([]dns.RR, len(set))
+				for i, rr := range set {
+					expanded[i] = dns.Copy(rr)
+					expanded[i].Header().Name = name
+				}
+				m.Answer = append(m.Answer, z.sign(tr.t, expanded, wildcard)...)
+				m.Ns = append(m.Ns, z.proof(tr.t, nil, []string{nextCloser})...)
+				return
+			}
+			z.negative(tr.t, m, []string{wildcard, ce}, []string{nextCloser})
+			return
+		}
+		m.Rcode = dns.RcodeNameError
+		z.negative(tr.t, m, []string{ce}, []string{nextCloser, wildcard})
+		return
+	}
+}
+
+// forTest returns a resolver for the same zones that fails t, for use in subtests
+func (tr *testResolver) forTest(t testing.TB) *testResolver {
+	return &testResolver{t: t, zones: tr.zones}
+}
+
+// lookup is the validator's lookup function
+func (tr *testResolver) lookup(name string, qtype uint16) (*dns.Msg, error) {
+	return tr.resolve(name, qtype), nil
+}
+
+// Exchange makes testResolver an upstream of a test server
+func (tr *testResolver) Exchange(ctx context.Context, r *dns.Msg) (*dns.Msg, error) {
+	q := r.Question[0]
+	resp := tr.resolve(q.Name, q.Qtype)
+	resp.Id = r.Id
+	resp.Question = r.Question
+	resp.RecursionAvailable = true
+	resp.SetEdns0(ednsUDPSize, true)
+	return resp, nil
+}
+
+func (tr *testResolver) String() string { return "test resolver" }
+
+// trustAnchor returns the DS of the test root
+func (tr *testResolver) trustAnchor() []*dns.DS {
+	return []*dns.DS{tr.zones["."].key.ToDS(dns.SHA256)}
+}
+
+func ofType(rrs []dns.RR, rtype uint16) []dns.RR {
+	var out []dns.RR
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == rtype {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// stripType removes records of the types from rrs
+func stripType(rrs []dns.RR, types ...uint16) []dns.RR {
+	var out []dns.RR
+	for _, rr := range rrs {
+		if !hasType(types, rr.Header().Rrtype) {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+func TestValidate(t *testing.T) {
+	tr := newTestResolver(t)
+
+	const bogus = -1
+	tests := []struct {
+		desc   string
+		name   string
+		qtype  uint16
+		rcode  int
+		modify func(m *dns.Msg)
+		want   dnssecState // or bogus
+	}{
+		{"secure answer", "www.secure.test.", dns.TypeA, dns.RcodeSuccess, nil, dnssecSecure},
+		{"secure CNAME chain", "alias.secure.test.", dns.TypeA, dns.RcodeSuccess, nil, dnssecSecure},
+		{"secure DNSKEY", "secure.test.", dns.TypeDNSKEY, dns.RcodeSuccess, nil, dnssecSecure},
+		{"insecure delegation", "www.insecure.test.", dns.TypeA, dns.RcodeSuccess, nil, dnssecInsecure},
+		{"CNAME into insecure zone", "out.secure.test.", dns.TypeA, dns.RcodeSuccess, nil, dnssecInsecure},
+		{"insecure NXDOMAIN", "nope.insecure.test.", dns.TypeA, dns.RcodeNameError, nil, dnssecInsecure},
+
+		{"DS does not match key", "www.bad.test.", dns.TypeA, dns.RcodeSuccess, nil, bogus},
+		{"expired RRSIG", "www.expired.test.", dns.TypeA, dns.RcodeSuccess, nil, bogus},
+		{"modified record", "www.secure.test.", dns.TypeA, dns.RcodeSuccess, func(m *dns.Msg) {
+			m.Answer[0].(*dns.A).A = net.ParseIP("203.0.113.1")
+		}, bogus},
+		{"stripped RRSIG", "www.secure.test.", dns.TypeA, dns.RcodeSuccess, func(m *dns.Msg) {
+			m.Answer = stripType(m.Answer, dns.TypeRRSIG)
+		}, bogus},
+
+		{"NSEC NXDOMAIN", "nope.secure.test.", dns.TypeA, dns.RcodeNameError, nil, dnssecSecure},
+		{"NSEC NXDOMAIN below a name", "a.nope.www.secure.test.", dns.TypeA, dns.RcodeNameError, nil, dnssecSecure},
+		{"NSEC NODATA", "www.secure.test.", dns.TypeTXT, dns.RcodeSuccess, nil, dnssecSecure},
+		{"NSEC NXDOMAIN without NSEC", "nope.secure.test.", dns.TypeA, dns.RcodeNameError, func(m *dns.Msg) {
+			m.Ns = stripType(m.Ns, dns.TypeNSEC)
+		}, bogus},
+		{"NSEC NODATA for existing type", "www.secure.test.", dns.TypeTXT, dns.RcodeSuccess, func(m *dns.Msg) {
+			m.Question[0].Qtype = dns.TypeA
+		}, bogus},
+		{"NXDOMAIN for existing name", "www.secure.test.", dns.TypeTXT, dns.RcodeSuccess, func(m *dns.Msg) {
+			m.Rcode = dns.RcodeNameError
+		}, bogus},
+
+		{"NSEC3 NXDOMAIN", "nope.nsec3.test.", dns.TypeA, dns.RcodeNameError, nil, dnssecSecure},
+		{"NSEC3 NODATA", "www.nsec3.test.", dns.TypeTXT, dns.RcodeSuccess, nil, dnssecSecure},
+		{"NSEC3 secure answer", "www.nsec3.test.", dns.TypeA, dns.RcodeSuccess, nil, dnssecSecure},
+		{"NSEC3 NXDOMAIN without NSEC3", "nope.nsec3.test.", dns.TypeA, dns.RcodeNameError, func(m *dns.Msg) {
+			m.Ns = stripType(m.Ns, dns.TypeNSEC3)
+		}, bogus},
+		{"NSEC3 NODATA for existing type", "www.nsec3.test.", dns.TypeTXT, dns.RcodeSuccess, func(m *dns.Msg) {
+			m.Question[0].Qtype = dns.TypeA
+		}, bogus},
+
+		{"wildcard answer", "x.wild.secure.test.", dns.TypeA, dns.RcodeSuccess, nil, dnssecSecure},
+		{"wildcard NODATA", "x.wild.secure.test.", dns.TypeMX, dns.RcodeSuccess, nil, dnssecSecure},
+		{"wildcard answer without NSEC", "x.wild.secure.test.", dns.TypeA, dns.RcodeSuccess, func(m *dns.Msg) {
+			m.Ns = nil
+		}, bogus},
+		{"wildcard answer for existing name", "x.wild.secure.test.", dns.TypeA, dns.RcodeSuccess, func(m *dns.Msg) {
+			for _, rr := range append(m.Answer, m.Ns...) {
+				if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == dns.TypeA {
+					sig.Hdr.Name = "wild.secure.test."
+				}
+			}
+			m.Answer[0].Header().Name = "wild.secure.test."
+			m.Question[0].Name = "wild.secure.test."
+		}, bogus},
+
+		{"NSEC3 opt-out delegation", "www.child.optout.test.", dns.TypeA, dns.RcodeSuccess, nil, dnssecInsecure},
+		{"NSEC3 opt-out NXDOMAIN", "nope.optout.test.", dns.TypeA, dns.RcodeNameError, nil, dnssecInsecure},
+		{"NSEC3 opt-out zone answer", "www.optout.test.", dns.TypeA, dns.RcodeSuccess, nil, dnssecSecure},
+
+		{"private zone denied by the root", "www.corp.internal.", dns.TypeA, dns.RcodeSuccess, nil, bogus},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			tr := tr.forTest(t)
+			v := newValidator(tr.lookup, nil)
+			v.anchors = tr.trustAnchor()
+
+			resp := tr.resolve(tt.name, tt.qtype)
+			if resp.Rcode != tt.rcode {
+				t.Fatalf("test resolver answered %s, want %s", dns.RcodeToString[resp.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if tt.modify != nil {
+				tt.modify(resp)
+			}
+
+			state, err := v.validate(resp, time.Now())
+			switch {
+			case tt.want == bogus && !errors.Is(err, errBogus):
+				t.Errorf("validate() = %v, %v; want bogus", state, err)
+			case tt.want != bogus && (err != nil || state != tt.want):
+				t.Errorf("validate() = %v, %v; want %v", state, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateNegativeTrustAnchor(t *testing.T) {
+	tr := newTestResolver(t)
+	v := newValidator(tr.lookup, []string{"Corp.Internal"})
+	v.anchors = tr.trustAnchor()
+
+	for _, name := range []string{"www.corp.internal.", "corp.internal."} {
+		state, err := v.validate(tr.resolve(name, dns.TypeA), time.Now())
+		if err != nil || state != dnssecInsecure {
+			t.Errorf("validate(%s) = %v, %v; want insecure", name, state, err)
+		}
+	}
+	// Names outside the anchor are still validated
+	if _, err := v.validate(tr.resolve("www.bad.test.", dns.TypeA), time.Now()); !errors.Is(err, errBogus) {
+		t.Errorf("validate(www.bad.test.) = %v, want bogus", err)
+	}
+}
+
+func TestDNSSECResponses(t *testing.T) {
+	tr := newTestResolver(t)
+	s := newTestServer(Config{
+		DNSSEC:       true,
+		ForwardRules: []ForwardRule{{Suffix: "corp.internal", Upstreams: []string{"10.0.0.53"}}},
+	}, tr)
+	s.validator.anchors = tr.trustAnchor()
+
+	tests := []struct {
+		name  string
+		do    bool
+		rcode int
+		ad    bool
+		ede   bool // Extended DNS Error "DNSSEC Bogus"
+	}{
+		{"www.secure.test.", true, dns.RcodeSuccess, true, false},
+		{"www.secure.test.", false, dns.RcodeSuccess, false, false},
+		{"www.insecure.test.", true, dns.RcodeSuccess, false, false},
+		{"www.bad.test.", true, dns.RcodeServerFailure, false, true},
+		{"www.expired.test.", true, dns.RcodeServerFailure, false, true},
+		{"www.corp.internal.", true, dns.RcodeSuccess, false, false},
+	}
+	for _, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion(tt.name, dns.TypeA)
+		r.SetEdns0(1232, tt.do)
+
+		m := exchange(t, s, r)
+		if m.Rcode != tt.rcode || m.AuthenticatedData != tt.ad {
+			t.Errorf("%s (DO %v): %s, AD %v; want %s, AD %v", tt.name, tt.do,
+				dns.RcodeToString[m.Rcode], m.AuthenticatedData, dns.RcodeToString[tt.rcode], tt.ad)
+		}
+		if !tt.do && len(ofType(m.Answer, dns.TypeRRSIG)) > 0 {
+			t.Errorf("%s: RRSIG sent to a client without DO", tt.name)
+		}
+		ede := false
+		if opt := m.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if e, ok := o.(*dns.EDNS0_EDE); ok && e.InfoCode == dns.ExtendedErrorCodeDNSBogus {
+					ede = true
+				}
+			}
+		}
+		if ede != tt.ede {
+			t.Errorf("%s: Extended DNS Error %v, want %v", tt.name, ede, tt.ede)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package dns
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dohPath        = "/dns-query"
+	dohContentType = "application/dns-message"
+)
+
+// dohHandler serves DNS-over-HTTPS queries (RFC 8484) with the same
+// decision logic as the UDP/TCP listeners
+func (s *Server) dohHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(dohPath, s.handleDoH)
+	return mux
+}
+
+// handleDoH handles GET (?dns=base64url) and POST (application/dns-message) queries
+func (s *Server) handleDoH(w http.ResponseWriter, req *http.Request) {
+	var packed []byte
+	var err error
+
+	switch req.Method {
+	case http.MethodGet:
+		packed, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+		if err != nil || len(packed) == 0 {
+			http.Error(w, "invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		// Parameters (e.g. charset) and the case of the media type do not matter
+		if mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type")); err != nil || mediaType != dohContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		packed, err = io.ReadAll(io.LimitReader(req.Body, dns.MaxMsgSize+1))
+		if err != nil || len(packed) == 0 || len(packed) > dns.MaxMsgSize {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(packed); err != nil {
+		http.Error(w, "malformed DNS message", http.StatusBadRequest)
+		return
+	}
+	// edns-tcp-keepalive only applies to raw DNS over TCP connections (RFC 7828)
+	if opt := r.IsEdns0(); opt != nil {
+		opt.Option = removeOption(opt.Option, dns.EDNS0TCPKEEPALIVE)
+	}
+
+	rw := &dohResponseWriter{
+		local:  addrFromString(req.Context().Value(http.LocalAddrContextKey)),
+		remote: addrFromString(req.RemoteAddr),
+	}
+	s.handleRequest(rw, r)
+
+	if rw.msg == nil {
+		http.Error(w, "no response", http.StatusInternalServerError)
+		return
+	}
+	out, err := rw.msg.Pack()
+	if err != nil {
+		log.Printf("[DNS] DoH pack error: %v", err)
+		http.Error(w, "pack error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(out)))
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minTTL(rw.msg)))
+	if _, err := w.Write(out); err != nil {
+		log.Printf("[DNS] DoH write error: %v", err)
+	}
+}
+
+// minTTL returns the smallest TTL in the message (0 if it has no records),
+// used as the HTTP freshness lifetime (RFC 8484 section 5.1)
+func minTTL(m *dns.Msg) uint32 {
+	var ttl uint32
+	first := true
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if first || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				first = false
+			}
+		}
+	}
+	return ttl
+}
+
+// addrFromString converts an HTTP address into a net.Addr so that
+// handlers see DoH clients as stream (non-UDP) clients
+func addrFromString(v interface{}) net.Addr {
+	switch a := v.(type) {
+	case net.Addr:
+		return a
+	case string:
+		if addr, err := net.ResolveTCPAddr("tcp", a); err == nil {
+			return addr
+		}
+	}
+	return &net.TCPAddr{}
+}
+
+// dohResponseWriter captures the response message of a DoH query
+type dohResponseWriter struct {
+	local  net.Addr
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr  { return w.local }
+func (w *dohResponseWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+func (w *dohResponseWriter) Close() error        { return nil }
+func (w *dohResponseWriter) TsigStatus() error   { return nil }
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+func (w *dohResponseWriter) Hijack()             {}
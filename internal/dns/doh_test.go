@@ -0,0 +1,54 @@
+package dns
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDoHContentType(t *testing.T) {
+	s := newTestServer(Config{}, new(testUpstream))
+	r := new(dns.Msg)
+	r.SetQuestion("www.example.test.", dns.TypeA)
+	packed, err := r.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		contentType string
+		status      int
+	}{
+		{"application/dns-message", http.StatusOK},
+		{"application/dns-message; charset=utf-8", http.StatusOK},
+		{"Application/DNS-Message", http.StatusOK},
+		{"application/dns-message ; foo=bar", http.StatusOK},
+		{"", http.StatusUnsupportedMediaType},
+		{"text/plain", http.StatusUnsupportedMediaType},
+		{"application/dns-message-x", http.StatusUnsupportedMediaType},
+		{"application/dns-message; =", http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, dohPath, bytes.NewReader(packed))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		rec := httptest.NewRecorder()
+		s.dohHandler().ServeHTTP(rec, req)
+
+		if rec.Code != tt.status {
+			t.Errorf("Content-Type %q: status %d, want %d", tt.contentType, rec.Code, tt.status)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		m := new(dns.Msg)
+		if err := m.Unpack(rec.Body.Bytes()); err != nil || m.Id != r.Id || len(m.Answer) != 1 {
+			t.Errorf("Content-Type %q: response %v, %v", tt.contentType, m, err)
+		}
+	}
+}
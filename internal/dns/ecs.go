@@ -0,0 +1,95 @@
+package dns
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// EDNS Client Subnet (RFC 7871) policies for forwarded queries
+const (
+	ECSStrip   = "strip"   // Remove ECS, upstreams only see our server's address
+	ECSPass    = "pass"    // Forward the client's ECS option unchanged
+	ECSReplace = "replace" // Send ECSSubnet instead of whatever the client sent
+)
+
+// checkECSConfig validates the ECS policy
+func checkECSConfig(cfg Config) error {
+	switch cfg.ECSPolicy {
+	case ECSStrip, ECSPass:
+	case ECSReplace:
+		if cfg.ECSSubnet == nil {
+			return fmt.Errorf("ECS policy %q requires a subnet", ECSReplace)
+		}
+	default:
+		return fmt.Errorf("unknown ECS policy %q", cfg.ECSPolicy)
+	}
+	return nil
+}
+
+// ecsQuery returns the query to send upstream with the ECS policy applied.
+// ECS is always stripped for spoofed names, so their real answers never
+// depend on (or reveal) the client's subnet. r is not modified.
+func (s *Server) ecsQuery(r *dns.Msg) *dns.Msg {
+	policy := s.config.ECSPolicy
+	if len(r.Question) > 0 && s.shouldSpoof(r.Question[0].Name) {
+		policy = ECSStrip
+	}
+
+	switch policy {
+	case ECSPass:
+		return r
+
+	case ECSReplace:
+		q := r.Copy()
+		opt := q.IsEdns0()
+		if opt == nil {
+			q.SetEdns0(dns.DefaultMsgSize, false)
+			opt = q.IsEdns0()
+		}
+		opt.Option = append(removeOption(opt.Option, dns.EDNS0SUBNET), newECSOption(s.config.ECSSubnet))
+		return q
+
+	default:
+		ecs := findECS(r)
+		if ecs == nil {
+			return r
+		}
+		log.Printf("[DNS] Stripping ECS %s/%d from query for %s", ecs.Address, ecs.SourceNetmask, r.Question[0].Name)
+		q := r.Copy()
+		opt := q.IsEdns0()
+		opt.Option = removeOption(opt.Option, dns.EDNS0SUBNET)
+		return q
+	}
+}
+
+// newECSOption builds an ECS option for subnet
+func newECSOption(subnet *net.IPNet) *dns.EDNS0_SUBNET {
+	ones, _ := subnet.Mask.Size()
+	ecs := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		SourceNetmask: uint8(ones),
+	}
+	if ip4 := subnet.IP.To4(); ip4 != nil {
+		ecs.Family = 1
+		ecs.Address = ip4
+	} else {
+		ecs.Family = 2
+		ecs.Address = subnet.IP
+	}
+	return ecs
+}
+
+// findECS returns the ECS option of m, if any
+func findECS(m *dns.Msg) *dns.EDNS0_SUBNET {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+				return ecs
+			}
+		}
+	}
+	return nil
+}
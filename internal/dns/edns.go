@@ -0,0 +1,165 @@
+package dns
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	ednsUDPSize = 1232 // Our advertised UDP payload size (DNS Flag Day 2020)
+	negativeTTL = 60   // TTL and SOA MINIMUM of synthetic SOA records in local negative answers
+
+	clientCookieLen = 8               // Client cookie length (RFC 7873 section 4)
+	serverCookieLen = 16              // Server cookie length (RFC 9018 layout)
+	cookieVersion   = 1               // Server cookie version (RFC 9018)
+	cookieMaxAge    = time.Hour       // Server cookies older than this are not valid
+	cookieMaxSkew   = 5 * time.Minute // Tolerated clock skew for server cookie timestamps
+)
+
+// setEDNS makes the response EDNS0-compliant for request r: no OPT if the
+// client did not use EDNS (RFC 6891 section 7), otherwise an OPT with our
+// buffer size, version 0, the client's DO bit (RFC 3225) and a DNS cookie
+// if the client sent one (RFC 7873).
+func (s *Server) setEDNS(r, m *dns.Msg, ip net.IP) {
+	ropt := r.IsEdns0()
+	if ropt == nil {
+		m.Extra = removeOPT(m.Extra)
+		return
+	}
+
+	opt := m.IsEdns0()
+	if opt == nil {
+		opt = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		m.Extra = append(m.Extra, opt)
+	}
+	opt.SetUDPSize(ednsUDPSize)
+	opt.SetVersion(0)
+	opt.SetDo(ropt.Do())
+	opt.Option = removeOption(opt.Option, dns.EDNS0COOKIE)
+
+	if cookie := findCookie(r); cookie != "" && len(cookie) >= clientCookieLen*2 {
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{
+			Code:   dns.EDNS0COOKIE,
+			Cookie: cookie[:clientCookieLen*2] + s.serverCookie(cookie, ip, uint32(time.Now().Unix())),
+		})
+	}
+}
+
+// findCookie returns the hex-encoded COOKIE option of m, or ""
+func findCookie(m *dns.Msg) string {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+				return c.Cookie
+			}
+		}
+	}
+	return ""
+}
+
+// malformedCookie reports whether r carries a COOKIE option of invalid
+// length, which must be answered with FORMERR (RFC 7873 section 5.2.2)
+func malformedCookie(r *dns.Msg) bool {
+	opt := r.IsEdns0()
+	if opt == nil || !hasOption(opt, dns.EDNS0COOKIE) {
+		return false
+	}
+	n := len(findCookie(r)) / 2
+	return n != clientCookieLen && (n < clientCookieLen+8 || n > clientCookieLen+32)
+}
+
+// serverCookie computes the server cookie for a client cookie and address
+// issued at the given Unix time: version, reserved, timestamp and a keyed
+// hash (RFC 9018 layout, with truncated HMAC-SHA256 as the hash)
+func (s *Server) serverCookie(cookie string, ip net.IP, timestamp uint32) string {
+	client, _ := hex.DecodeString(cookie[:clientCookieLen*2])
+
+	out := make([]byte, 8, serverCookieLen)
+	out[0] = cookieVersion
+	binary.BigEndian.PutUint32(out[4:8], timestamp)
+
+	mac := hmac.New(sha256.New, s.cookieSecret)
+	mac.Write(client)
+	mac.Write(out)
+	if ip4 := ip.To4(); ip4 != nil {
+		mac.Write(ip4)
+	} else {
+		mac.Write(ip.To16())
+	}
+	out = append(out, mac.Sum(nil)[:serverCookieLen-8]...)
+	return hex.EncodeToString(out)
+}
+
+// validCookie reports whether r carries a server cookie we issued to this
+// client address recently, proving the address is not spoofed
+func (s *Server) validCookie(r *dns.Msg, ip net.IP, now time.Time) bool {
+	cookie := findCookie(r)
+	if len(cookie) != (clientCookieLen+serverCookieLen)*2 || ip == nil {
+		return false
+	}
+	raw, err := hex.DecodeString(cookie)
+	if err != nil || raw[clientCookieLen] != cookieVersion {
+		return false
+	}
+
+	timestamp := binary.BigEndian.Uint32(raw[clientCookieLen+4 : clientCookieLen+8])
+	issued := time.Unix(int64(timestamp), 0)
+	if now.Sub(issued) > cookieMaxAge || issued.Sub(now) > cookieMaxSkew {
+		return false
+	}
+	return hmac.Equal([]byte(s.serverCookie(cookie, ip, timestamp)), []byte(cookie[clientCookieLen*2:]))
+}
+
+// newCookieSecret returns a random key for server cookies
+func newCookieSecret() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic("dns: cannot generate cookie secret: " + err.Error())
+	}
+	return secret
+}
+
+// upstreamQuery returns the query to send upstream: hop-by-hop EDNS options
+// (cookies, TCP keepalive) are removed and the ECS policy applied.
+// r is not modified.
+func (s *Server) upstreamQuery(r *dns.Msg) *dns.Msg {
+	q := s.ecsQuery(r)
+	opt := q.IsEdns0()
+	if opt == nil || !(hasOption(opt, dns.EDNS0COOKIE) || hasOption(opt, dns.EDNS0TCPKEEPALIVE)) {
+		return q
+	}
+	if q == r {
+		q = r.Copy()
+		opt = q.IsEdns0()
+	}
+	opt.Option = removeOption(removeOption(opt.Option, dns.EDNS0COOKIE), dns.EDNS0TCPKEEPALIVE)
+	return q
+}
+
+// syntheticSOA returns the SOA record placed in the authority section of
+// local NODATA/NXDOMAIN answers for zone, so clients can cache them (RFC 2308)
+func syntheticSOA(zone string) *dns.SOA {
+	zone = dns.Fqdn(zone)
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    negativeTTL,
+		},
+		Ns:      zone,
+		Mbox:    "hostmaster." + zone,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  negativeTTL,
+	}
+}
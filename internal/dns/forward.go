@@ -0,0 +1,133 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ForwardRule sends queries for names under Suffix to its own upstreams
+// instead of the generic UpstreamDNS list (split-horizon / conditional forwarding)
+type ForwardRule struct {
+	Suffix    string   // Domain suffix (e.g., "corp.internal") or CIDR for reverse zones (e.g., "10.0.0.0/8")
+	Upstreams []string // Upstream DNS servers for this suffix, same formats as UpstreamDNS
+}
+
+// forwardZone is a parsed ForwardRule
+type forwardZone struct {
+	suffix string // Lowercase, without leading/trailing dots
+	pool   *upstreamPool
+}
+
+// ParseForwardRule parses "suffix=upstream1,upstream2"
+func ParseForwardRule(s string) (ForwardRule, error) {
+	suffix, list, ok := strings.Cut(s, "=")
+	if !ok || strings.TrimSpace(suffix) == "" {
+		return ForwardRule{}, fmt.Errorf("invalid forward rule %q, expected suffix=upstream[,upstream...]", s)
+	}
+
+	rule := ForwardRule{Suffix: strings.TrimSpace(suffix)}
+	for _, u := range strings.Split(list, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			rule.Upstreams = append(rule.Upstreams, u)
+		}
+	}
+	if len(rule.Upstreams) == 0 {
+		return ForwardRule{}, fmt.Errorf("forward rule %q has no upstreams", s)
+	}
+	return rule, nil
+}
+
+// zoneSuffix normalizes a rule suffix; CIDRs are converted to their reverse zone
+func zoneSuffix(suffix string) (string, error) {
+	if strings.Contains(suffix, "/") {
+		return reverseZone(suffix)
+	}
+	return strings.ToLower(strings.Trim(suffix, ".")), nil
+}
+
+// reverseZone returns the in-addr.arpa/ip6.arpa zone of a CIDR.
+// The prefix length must fall on an octet (IPv4) or nibble (IPv6) boundary.
+func reverseZone(cidr string) (string, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", err
+	}
+	ones, bits := network.Mask.Size()
+
+	var labels []string
+	if ip4 := network.IP.To4(); ip4 != nil && bits == 32 {
+		if ones%8 != 0 {
+			return "", fmt.Errorf("%s: IPv4 prefix length must be a multiple of 8", cidr)
+		}
+		for i := ones/8 - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprint(ip4[i]))
+		}
+		labels = append(labels, "in-addr", "arpa")
+	} else {
+		if ones%4 != 0 {
+			return "", fmt.Errorf("%s: IPv6 prefix length must be a multiple of 4", cidr)
+		}
+		for i := ones/4 - 1; i >= 0; i-- {
+			b := network.IP[i/2]
+			if i%2 == 0 {
+				b >>= 4
+			}
+			labels = append(labels, fmt.Sprintf("%x", b&0x0f))
+		}
+		labels = append(labels, "ip6", "arpa")
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// forwardSuffixes returns the valid suffixes of the forward rules as domain
+// names, e.g. for use as DNSSEC negative trust anchors
+func forwardSuffixes(rules []ForwardRule) []string {
+	var suffixes []string
+	for _, rule := range rules {
+		if suffix, err := zoneSuffix(rule.Suffix); err == nil {
+			suffixes = append(suffixes, dns.Fqdn(suffix))
+		}
+	}
+	return suffixes
+}
+
+// newForwardZones builds the conditional forwarding table, longest suffix first
+func newForwardZones(rules []ForwardRule, newPool func([]string) (*upstreamPool, error)) ([]forwardZone, error) {
+	zones := make([]forwardZone, 0, len(rules))
+	for _, rule := range rules {
+		suffix, err := zoneSuffix(rule.Suffix)
+		if err != nil {
+			return nil, fmt.Errorf("forward rule %q: %w", rule.Suffix, err)
+		}
+		pool, err := newPool(rule.Upstreams)
+		if err != nil {
+			return nil, fmt.Errorf("forward rule %q: %w", rule.Suffix, err)
+		}
+		zones = append(zones, forwardZone{suffix: suffix, pool: pool})
+	}
+
+	sort.SliceStable(zones, func(i, j int) bool {
+		return len(zones[i].suffix) > len(zones[j].suffix)
+	})
+	return zones, nil
+}
+
+// poolFor returns the upstreams for a query: the most specific matching
+// forward rule, or the generic upstream list
+func (s *Server) poolFor(r *dns.Msg) *upstreamPool {
+	if len(s.forwardZones) == 0 || len(r.Question) == 0 {
+		return s.upstreams
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(r.Question[0].Name, "."))
+	for _, zone := range s.forwardZones {
+		if name == zone.suffix || strings.HasSuffix(name, "."+zone.suffix) {
+			return zone.pool
+		}
+	}
+	return s.upstreams
+}
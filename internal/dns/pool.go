@@ -0,0 +1,249 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream selection strategies
+const (
+	StrategySequential = "sequential"  // Try upstreams in configured order
+	StrategyParallel   = "parallel"    // Query all upstreams at once, first answer wins
+	StrategyFastest    = "fastest"     // Try upstreams ordered by observed latency
+	StrategyRoundRobin = "round-robin" // Rotate the first upstream on every query
+)
+
+const (
+	failureThreshold = 2               // Consecutive failures before an upstream is marked down
+	minBackoff       = 5 * time.Second // First down period
+	maxBackoff       = 5 * time.Minute // Longest down period
+	latencyWeight    = 0.3             // Weight of the newest sample in the latency average
+)
+
+// upstreamState wraps an upstream with passive health tracking and counters
+type upstreamState struct {
+	upstream
+	queries  atomic.Uint64
+	failures atomic.Uint64
+	latency  atomic.Int64 // Moving average of successful exchanges, in nanoseconds
+
+	mu          sync.Mutex
+	consecutive int       // Consecutive failures
+	downUntil   time.Time // Skipped (unless all upstreams are down) until then
+}
+
+// healthy reports whether the upstream is not in a backoff period
+func (u *upstreamState) healthy(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !now.Before(u.downUntil)
+}
+
+// record updates counters and health state after an exchange
+func (u *upstreamState) record(rtt time.Duration, err error) {
+	u.queries.Add(1)
+
+	if err == nil {
+		old := time.Duration(u.latency.Load())
+		if old == 0 {
+			u.latency.Store(int64(rtt))
+		} else {
+			u.latency.Store(int64(float64(old)*(1-latencyWeight) + float64(rtt)*latencyWeight))
+		}
+
+		u.mu.Lock()
+		if u.consecutive >= failureThreshold {
+			log.Printf("[DNS] Upstream %s is back up", u)
+		}
+		u.consecutive = 0
+		u.downUntil = time.Time{}
+		u.mu.Unlock()
+		return
+	}
+
+	u.failures.Add(1)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.consecutive++
+	if u.consecutive >= failureThreshold {
+		backoff := minBackoff << min(u.consecutive-failureThreshold, 6)
+		backoff = min(backoff, maxBackoff)
+		u.downUntil = time.Now().Add(backoff)
+		log.Printf("[DNS] Upstream %s marked down for %s after %d consecutive failures", u, backoff, u.consecutive)
+	}
+}
+
+// upstreamPool selects upstreams according to a strategy
+type upstreamPool struct {
+	strategy  string
+	timeout   time.Duration
+	upstreams []*upstreamState
+	next      atomic.Uint64 // Round-robin position
+}
+
+// newUpstreamPool creates a pool from upstream addresses
+func newUpstreamPool(addrs []string, strategy string, timeout time.Duration, dialer *net.Dialer) (*upstreamPool, error) {
+	switch strategy {
+	case "":
+		strategy = StrategySequential
+	case StrategySequential, StrategyParallel, StrategyFastest, StrategyRoundRobin:
+	default:
+		return nil, fmt.Errorf("unknown upstream strategy %q", strategy)
+	}
+
+	p := &upstreamPool{strategy: strategy, timeout: timeout}
+	for _, addr := range addrs {
+		u, err := parseUpstream(addr, timeout, dialer)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: %w", addr, err)
+		}
+		p.upstreams = append(p.upstreams, &upstreamState{upstream: u})
+	}
+	return p, nil
+}
+
+// ordered returns the upstreams in the order they should be tried:
+// healthy ones ordered by the strategy, followed by those in backoff
+// (so that a query still goes out when every upstream is down)
+func (p *upstreamPool) ordered() []*upstreamState {
+	list := make([]*upstreamState, len(p.upstreams))
+	copy(list, p.upstreams)
+
+	switch p.strategy {
+	case StrategyRoundRobin:
+		if n := len(list); n > 0 {
+			start := int((p.next.Add(1) - 1) % uint64(n)) // Unsigned: no negative index once the counter wraps
+			list = append(list[start:], list[:start]...)
+		}
+	case StrategyFastest:
+		// Upstreams without samples sort first, so they get measured
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].latency.Load() < list[j].latency.Load()
+		})
+	}
+
+	now := time.Now()
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].healthy(now) && !list[j].healthy(now)
+	})
+	return list
+}
+
+// exchange forwards r according to the strategy
+func (p *upstreamPool) exchange(r *dns.Msg) (*dns.Msg, error) {
+	list := p.ordered()
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no upstream servers configured")
+	}
+	if p.strategy == StrategyParallel {
+		return p.race(list, r)
+	}
+
+	var lastErr error
+	for _, u := range list {
+		log.Printf("[DNS] Forwarding to upstream %s", u)
+
+		resp, err := p.exchangeOne(context.Background(), u, r)
+		if err != nil {
+			log.Printf("[DNS] Upstream %s error: %v", u, err)
+			lastErr = err
+			continue
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+// race queries all healthy upstreams (or all of them, if none is healthy)
+// concurrently and returns the first successful response
+func (p *upstreamPool) race(list []*upstreamState, r *dns.Msg) (*dns.Msg, error) {
+	now := time.Now()
+	healthy := list[:0:0]
+	for _, u := range list {
+		if u.healthy(now) {
+			healthy = append(healthy, u)
+		}
+	}
+	if len(healthy) > 0 {
+		list = healthy
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type result struct {
+		resp *dns.Msg
+		err  error
+	}
+	results := make(chan result, len(list))
+	for _, u := range list {
+		go func(u *upstreamState) {
+			// Each upstream gets its own copy, exchanges may modify the ID
+			resp, err := p.exchangeOne(ctx, u, r.Copy())
+			if err != nil && ctx.Err() == nil {
+				log.Printf("[DNS] Upstream %s error: %v", u, err)
+			}
+			results <- result{resp, err}
+		}(u)
+	}
+	log.Printf("[DNS] Forwarding to %d upstreams in parallel", len(list))
+
+	var lastErr error
+	for range list {
+		res := <-results
+		if res.err == nil {
+			return res.resp, nil
+		}
+		lastErr = res.err
+	}
+	return nil, lastErr
+}
+
+// exchangeOne sends r to a single upstream and records the outcome.
+// Exchanges cancelled because another upstream won a race are not failures.
+func (p *upstreamPool) exchangeOne(ctx context.Context, u *upstreamState, r *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	start := time.Now()
+	resp, err := u.Exchange(ctx, r)
+	if err != nil && ctx.Err() == context.Canceled {
+		return nil, err
+	}
+	u.record(time.Since(start), err)
+	return resp, err
+}
+
+// stats returns a snapshot of the upstream counters
+func (p *upstreamPool) stats() []UpstreamStats {
+	now := time.Now()
+	stats := make([]UpstreamStats, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		stats = append(stats, UpstreamStats{
+			Address:  u.String(),
+			Queries:  u.queries.Load(),
+			Failures: u.failures.Load(),
+			Latency:  time.Duration(u.latency.Load()),
+			Healthy:  u.healthy(now),
+		})
+	}
+	return stats
+}
+
+// UpstreamStats holds counters of one upstream server
+type UpstreamStats struct {
+	Address  string        // Upstream address as configured
+	Queries  uint64        // Exchanges attempted
+	Failures uint64        // Exchanges that failed (errors and timeouts)
+	Latency  time.Duration // Moving average latency of successful exchanges
+	Healthy  bool          // False while the upstream is in failure backoff
+}
@@ -0,0 +1,23 @@
+package dns
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRoundRobinWraps(t *testing.T) {
+	p := &upstreamPool{strategy: StrategyRoundRobin}
+	for i := 0; i < 3; i++ {
+		p.upstreams = append(p.upstreams, &upstreamState{upstream: new(testUpstream)})
+	}
+
+	for _, next := range []uint64{math.MaxInt32, math.MaxInt64, math.MaxUint64} {
+		p.next.Store(next)
+		for i := uint64(0); i < 3; i++ {
+			got := p.ordered()
+			if want := p.upstreams[(next+i)%3]; len(got) != 3 || got[0] != want {
+				t.Errorf("ordered at %d starts with upstream %p, want %p", next+i, got[0], want)
+			}
+		}
+	}
+}
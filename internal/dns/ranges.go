@@ -0,0 +1,59 @@
+package dns
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// spoofRanges rewrites a forwarded A/AAAA answer that resolves into one of
+// Config.SpoofNetworks: the CNAMEs are kept and the addresses are replaced by
+// the default spoof addresses (NODATA without an address of the family).
+// Names with a rule are left to it. Returns false if the answer was left unchanged.
+func (s *Server) spoofRanges(r, resp *dns.Msg) bool {
+	q := r.Question[0]
+	if len(s.config.SpoofNetworks) == 0 || (q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA) {
+		return false
+	}
+	if resp.Rcode != dns.RcodeSuccess || s.matchRule(q.Name) != nil {
+		return false
+	}
+
+	var hit net.IP
+	var owner string
+	for _, rr := range resp.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		if containsIP(s.config.SpoofNetworks, ip) {
+			hit, owner = ip, rr.Header().Name
+			break
+		}
+	}
+	if hit == nil {
+		return false
+	}
+
+	var chain []dns.RR
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == dns.TypeCNAME {
+			chain = append(chain, rr)
+		}
+	}
+	resp.Answer = chain
+	resp.Ns = nil
+	ips := spoofAddresses(resp, q.Qtype, owner, s.spoofNetAddrs, uint32(s.config.SpoofTTL/time.Second))
+	if len(ips) == 0 {
+		resp.Ns = append(resp.Ns, syntheticSOA(owner))
+	}
+	log.Printf("[DNS] Spoofing %s (type %s): answer %s in spoofed range -> %v", q.Name, dns.TypeToString[q.Qtype], hit, ips)
+	return true
+}
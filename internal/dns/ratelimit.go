@@ -0,0 +1,181 @@
+package dns
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	ipv4PrefixLen      = 24          // Clients are grouped by /24 (IPv4) ...
+	ipv6PrefixLen      = 56          // ... and /56 (IPv6), like BIND RRL
+	limiterIdleTimeout = time.Minute // Buckets unused for this long are removed
+	maxLimiterBuckets  = 100000      // Buckets per limiter; spoofed sources cannot grow it further
+)
+
+// bucket is a token bucket
+type bucket struct {
+	tokens  float64
+	last    time.Time
+	dropped uint64 // Responses dropped since creation, drives RRL slip
+}
+
+// limiter holds token buckets per key
+type limiter struct {
+	mu        sync.Mutex
+	rate      float64 // Tokens added per second
+	burst     float64 // Bucket size
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func newLimiter(rate float64, burst int) *limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// take takes a token for key. If the bucket is empty it returns false and
+// the number of drops for this key so far (including this one).
+func (l *limiter) take(key string, now time.Time) (bool, uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > limiterIdleTimeout {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > limiterIdleTimeout {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok && len(l.buckets) >= maxLimiterBuckets {
+		// Full of active buckets: evict a random one
+		for k := range l.buckets {
+			delete(l.buckets, k)
+			break
+		}
+	}
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	b.dropped++
+	return false, b.dropped
+}
+
+// clientPrefix returns the network a client address belongs to
+func clientPrefix(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(ipv4PrefixLen, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(ipv6PrefixLen, 128)).String()
+}
+
+// rrlDecision is the outcome of response rate limiting
+type rrlDecision int
+
+const (
+	rrlSend rrlDecision = iota // Send the response
+	rrlDrop                    // Drop the response
+	rrlSlip                    // Send an empty truncated response instead
+)
+
+// rateLimiter implements per-client query limits and response rate
+// limiting (RRL) for UDP, where source addresses can be spoofed
+type rateLimiter struct {
+	queries    *limiter // Per client prefix, nil if disabled
+	responses  *limiter // Per client prefix and response, nil if disabled
+	slip       uint64   // Every slip-th dropped response is sent truncated (0 never)
+	qDropped   atomic.Uint64
+	rrlDropped atomic.Uint64
+	rrlSlipped atomic.Uint64
+}
+
+// allowQuery applies the per-client query limit
+func (rl *rateLimiter) allowQuery(ip net.IP, now time.Time) bool {
+	if rl.queries == nil || ip == nil {
+		return true
+	}
+	if ok, _ := rl.queries.take(clientPrefix(ip), now); !ok {
+		rl.qDropped.Add(1)
+		return false
+	}
+	return true
+}
+
+// checkResponse applies RRL to response m for a client. Answers to the same
+// client prefix share a budget per name and type; NXDOMAIN and NODATA share
+// one per zone (the SOA owner in the authority section), so random-subdomain
+// floods are limited too, and other errors share one per prefix.
+func (rl *rateLimiter) checkResponse(ip net.IP, m *dns.Msg, now time.Time) rrlDecision {
+	if rl.responses == nil || ip == nil {
+		return rrlSend
+	}
+
+	key := clientPrefix(ip) + "|" + strconv.Itoa(m.Rcode)
+	switch {
+	case m.Rcode == dns.RcodeSuccess && len(m.Answer) > 0 && len(m.Question) > 0:
+		q := m.Question[0]
+		key += "|" + strings.ToLower(q.Name) + "|" + strconv.Itoa(int(q.Qtype))
+	case m.Rcode == dns.RcodeSuccess || m.Rcode == dns.RcodeNameError:
+		key += "|" + negativeZone(m)
+	}
+
+	ok, dropped := rl.responses.take(key, now)
+	if ok {
+		return rrlSend
+	}
+	if rl.slip > 0 && dropped%rl.slip == 0 {
+		rl.rrlSlipped.Add(1)
+		return rrlSlip
+	}
+	rl.rrlDropped.Add(1)
+	return rrlDrop
+}
+
+// negativeZone returns the lowercase owner of the SOA record in the authority
+// section of a negative response, or "" if there is none
+func negativeZone(m *dns.Msg) string {
+	for _, rr := range m.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return strings.ToLower(soa.Hdr.Name)
+		}
+	}
+	return ""
+}
+
+// RateLimitStats holds rate limiting counters
+type RateLimitStats struct {
+	QueriesDropped   uint64 // Queries dropped by the per-client query limit
+	ResponsesDropped uint64 // Responses dropped by RRL
+	ResponsesSlipped uint64 // Responses replaced by a truncated reply by RRL
+}
+
+// RateLimitStats returns the rate limiting counters
+func (s *Server) RateLimitStats() RateLimitStats {
+	return RateLimitStats{
+		QueriesDropped:   s.limits.qDropped.Load(),
+		ResponsesDropped: s.limits.rrlDropped.Load(),
+		ResponsesSlipped: s.limits.rrlSlipped.Load(),
+	}
+}
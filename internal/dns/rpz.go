@@ -0,0 +1,315 @@
+package dns
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"DnsSpoofer/internal/match"
+)
+
+// RPZ policy actions (draft-vixie-dnsop-dns-rpz)
+const (
+	RPZNXDomain  = "nxdomain"   // CNAME .
+	RPZNoData    = "nodata"     // CNAME *.
+	RPZPassthru  = "passthru"   // CNAME rpz-passthru.
+	RPZLocalData = "local-data" // Any other records, answered instead of the real data
+)
+
+// RPZPolicy is one trigger of a response policy zone
+type RPZPolicy struct {
+	Pattern string     // QNAME trigger as a name pattern ("=name" or "*.name"), empty for response-IP triggers
+	Network *net.IPNet // Response-IP trigger, matched against A/AAAA records of forwarded answers
+	Action  string     // RPZNXDomain, RPZNoData, RPZPassthru or RPZLocalData
+	Records []dns.RR   // Local data, with the trigger as owner
+}
+
+// RPZ is a response policy zone loaded from a zone file
+type RPZ struct {
+	Name     string // Zone name (owner of the SOA record)
+	Path     string // File the zone was loaded from
+	Policies []RPZPolicy
+}
+
+// LoadRPZ loads a response policy zone file. QNAME triggers ("bad.example.com",
+// "*.bad.example.com") and response-IP triggers ("32.1.2.0.192.rpz-ip",
+// "48.zz.db8.2001.rpz-ip") are supported; NSDNAME, NSIP and client-IP
+// triggers, rpz-drop and rpz-tcp-only are skipped.
+func LoadRPZ(path string) (RPZ, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return RPZ{}, fmt.Errorf("RPZ %s: %w", path, err)
+	}
+	defer f.Close()
+
+	zone := RPZ{Name: ".", Path: path}
+	var owners []string
+	records := make(map[string][]dns.RR)
+	zp := dns.NewZoneParser(f, ".", path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		owner := strings.ToLower(rr.Header().Name)
+		switch rr.Header().Rrtype {
+		case dns.TypeSOA:
+			zone.Name = owner
+			continue
+		case dns.TypeNS:
+			continue
+		}
+		if _, seen := records[owner]; !seen {
+			owners = append(owners, owner)
+		}
+		records[owner] = append(records[owner], rr)
+	}
+	if err := zp.Err(); err != nil {
+		return RPZ{}, fmt.Errorf("RPZ %s: %w", path, err)
+	}
+
+	skipped := 0
+	for _, owner := range owners {
+		policy, err := parseRPZPolicy(zone.Name, owner, records[owner])
+		if err != nil {
+			skipped++
+			continue
+		}
+		zone.Policies = append(zone.Policies, policy)
+	}
+	if skipped > 0 {
+		log.Printf("[DNS] RPZ %s: skipped %d unsupported triggers", zone.Name, skipped)
+	}
+	return zone, nil
+}
+
+// parseRPZPolicy builds the policy of the records owned by one trigger name
+func parseRPZPolicy(zone, owner string, rrs []dns.RR) (RPZPolicy, error) {
+	if !dns.IsSubDomain(zone, owner) || owner == zone {
+		return RPZPolicy{}, fmt.Errorf("trigger %s outside of zone %s", owner, zone)
+	}
+	labels := dns.SplitDomainName(owner)
+	labels = labels[:len(labels)-dns.CountLabel(zone)]
+
+	var policy RPZPolicy
+	switch last := labels[len(labels)-1]; last {
+	case "rpz-ip":
+		network, err := parseRPZIP(labels[:len(labels)-1])
+		if err != nil {
+			return RPZPolicy{}, err
+		}
+		policy.Network = network
+	case "rpz-nsdname", "rpz-nsip", "rpz-client-ip":
+		return RPZPolicy{}, fmt.Errorf("unsupported trigger %s", owner)
+	default:
+		name := strings.Join(labels, ".")
+		if rest, ok := strings.CutPrefix(name, "*."); ok {
+			policy.Pattern = "*." + rest
+		} else {
+			policy.Pattern = "=" + name
+		}
+		if _, err := match.Parse(policy.Pattern); err != nil {
+			return RPZPolicy{}, err
+		}
+	}
+
+	if cname, ok := rrs[0].(*dns.CNAME); ok && len(rrs) == 1 {
+		switch strings.ToLower(cname.Target) {
+		case ".":
+			policy.Action = RPZNXDomain
+		case "*.":
+			policy.Action = RPZNoData
+		case "rpz-passthru.":
+			policy.Action = RPZPassthru
+		case "rpz-drop.", "rpz-tcp-only.":
+			return RPZPolicy{}, fmt.Errorf("unsupported action %s for %s", cname.Target, owner)
+		}
+		if policy.Action != "" {
+			return policy, nil
+		}
+		if strings.HasPrefix(cname.Target, "*.") {
+			return RPZPolicy{}, fmt.Errorf("unsupported wildcard CNAME %s for %s", cname.Target, owner)
+		}
+	}
+	policy.Action = RPZLocalData
+	policy.Records = rrs
+	return policy, nil
+}
+
+// parseRPZIP parses the labels of a response-IP trigger before "rpz-ip": the
+// prefix length followed by the address in reverse order, "zz" standing for
+// "::" in IPv6 addresses
+func parseRPZIP(labels []string) (*net.IPNet, error) {
+	if len(labels) < 2 {
+		return nil, fmt.Errorf("invalid rpz-ip trigger %v", labels)
+	}
+	bits, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid rpz-ip prefix length %q", labels[0])
+	}
+	addr := slices.Clone(labels[1:])
+	slices.Reverse(addr)
+
+	var s string
+	size := 128
+	if len(addr) == 4 && !slices.Contains(addr, "zz") {
+		s, size = strings.Join(addr, "."), 32
+	} else {
+		for i := range addr {
+			if addr[i] == "zz" {
+				addr[i] = ""
+			}
+		}
+		s = strings.Join(addr, ":")
+		if strings.HasPrefix(s, ":") {
+			s = ":" + s
+		}
+		if strings.HasSuffix(s, ":") {
+			s += ":"
+		}
+	}
+	ip := net.ParseIP(s)
+	if ip == nil || bits < 0 || bits > size {
+		return nil, fmt.Errorf("invalid rpz-ip trigger %s/%d", s, bits)
+	}
+	if size == 32 {
+		ip = ip.To4()
+	}
+	return &net.IPNet{IP: ip.Mask(net.CIDRMask(bits, size)), Mask: net.CIDRMask(bits, size)}, nil
+}
+
+// rpzZone is a loaded response policy zone
+type rpzZone struct {
+	name  string
+	qname *match.Matcher[*rpzPolicy]
+	ips   []rpzIPPolicy // Longest prefix first
+}
+
+// rpzPolicy is the action of a trigger
+type rpzPolicy struct {
+	action string
+	rule   *rule // Local answer, nil for PASSTHRU
+}
+
+// rpzIPPolicy is a response-IP trigger
+type rpzIPPolicy struct {
+	network *net.IPNet
+	policy  *rpzPolicy
+}
+
+// newRPZZones builds the trigger matchers of the zones
+func newRPZZones(zones []RPZ) []*rpzZone {
+	out := make([]*rpzZone, 0, len(zones))
+	for _, z := range zones {
+		zone := &rpzZone{name: z.Name, qname: match.New[*rpzPolicy]()}
+		for _, p := range z.Policies {
+			policy := &rpzPolicy{action: p.Action}
+			switch p.Action {
+			case RPZNXDomain:
+				policy.rule = &rule{action: ActionNXDomain}
+			case RPZNoData, RPZLocalData:
+				policy.rule = &rule{action: ActionStatic, records: p.Records}
+			}
+			if p.Network != nil {
+				zone.ips = append(zone.ips, rpzIPPolicy{network: p.Network, policy: policy})
+				continue
+			}
+			if err := zone.qname.Add(p.Pattern, policy); err != nil {
+				log.Printf("[DNS] RPZ %s: ignoring trigger: %v", z.Name, err)
+			}
+		}
+		slices.SortStableFunc(zone.ips, func(a, b rpzIPPolicy) int {
+			ones, _ := a.network.Mask.Size()
+			other, _ := b.network.Mask.Size()
+			return other - ones
+		})
+		out = append(out, zone)
+	}
+	return out
+}
+
+// matchIP returns the policy of the longest response-IP trigger containing ip
+func (z *rpzZone) matchIP(ip net.IP) *rpzPolicy {
+	for _, p := range z.ips {
+		if p.network.Contains(ip) {
+			return p.policy
+		}
+	}
+	return nil
+}
+
+// rpzQNAME returns the QNAME policy for name from the first zone with a
+// matching trigger, or nil if no zone has one
+func (s *Server) rpzQNAME(name string) (*rpzZone, *rpzPolicy) {
+	for _, z := range s.rpz {
+		if p, ok := z.qname.Match(name); ok {
+			return z, p
+		}
+	}
+	return nil, nil
+}
+
+// rpzReply applies QNAME policies. It returns the local answer and true if a
+// policy matched; the answer is nil for PASSTHRU, which forwards the query
+// without checking blocklists. Names with a rule or spoof pattern are
+// answered by that rule, RPZ does not apply to them.
+func (s *Server) rpzReply(r *dns.Msg) (*dns.Msg, bool) {
+	if len(s.rpz) == 0 {
+		return nil, false
+	}
+	q := r.Question[0]
+	if q.Qclass != dns.ClassINET || s.matchRule(q.Name) != nil {
+		return nil, false
+	}
+	zone, policy := s.rpzQNAME(q.Name)
+	if policy == nil {
+		return nil, false
+	}
+	log.Printf("[DNS] RPZ %s: %s (type %s) -> %s", zone.name, q.Name, dns.TypeToString[q.Qtype], policy.action)
+	if policy.rule == nil {
+		return nil, true
+	}
+	return ruleReply(r, policy.rule), true
+}
+
+// rpzResponse applies response-IP policies to a forwarded answer, returning
+// the local answer replacing it or nil to send it unchanged. QNAME policies
+// take precedence, so names with a QNAME trigger (PASSTHRU) are skipped.
+func (s *Server) rpzResponse(r, resp *dns.Msg) *dns.Msg {
+	if len(s.rpz) == 0 || resp.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+	q := r.Question[0]
+	if s.matchRule(q.Name) != nil {
+		return nil
+	}
+	if _, policy := s.rpzQNAME(q.Name); policy != nil {
+		return nil
+	}
+
+	for _, z := range s.rpz {
+		for _, rr := range resp.Answer {
+			var ip net.IP
+			switch rr := rr.(type) {
+			case *dns.A:
+				ip = rr.A
+			case *dns.AAAA:
+				ip = rr.AAAA
+			default:
+				continue
+			}
+			policy := z.matchIP(ip)
+			if policy == nil {
+				continue
+			}
+			log.Printf("[DNS] RPZ %s: %s (type %s) answer %s -> %s", z.name, q.Name, dns.TypeToString[q.Qtype], ip, policy.action)
+			if policy.rule == nil {
+				return nil
+			}
+			return ruleReply(r, policy.rule)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package dns
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"DnsSpoofer/internal/match"
+)
+
+// Rule actions
+const (
+	ActionSpoof    = "spoof"    // A/AAAA answered with spoof addresses, HTTPS/SVCB with NODATA, the rest forwarded
+	ActionForward  = "forward"  // Always forwarded upstream, never spoofed or proxied
+	ActionNXDomain = "nxdomain" // NXDOMAIN for every type
+	ActionSinkhole = "sinkhole" // A/AAAA answered with 0.0.0.0 and ::, NODATA for every other type
+	ActionStatic   = "static"   // Answered from the rule's records, NODATA for types without records
+)
+
+// localTTL is the TTL of locally generated answers
+const localTTL = 60
+
+// sinkholeAddrs are the addresses answered by the sinkhole action
+var sinkholeAddrs = newSpoofAddrs([]net.IP{net.IPv4zero, net.IPv6unspecified})
+
+// Rule applies an action to names matching its patterns
+type Rule struct {
+	Patterns []string      // Name patterns (e.g., ".example.com", see package match)
+	Action   string        // ActionSpoof, ActionForward, ActionNXDomain, ActionSinkhole or ActionStatic
+	IPs      []net.IP      // Addresses for ActionSpoof, Config.SpoofIPs if empty
+	Records  []string      // Record data for ActionStatic, e.g. "A 192.0.2.1" or `TXT "hello"`
+	TTL      time.Duration // TTL of the rule's answers, Config.SpoofTTL if 0
+}
+
+// ParseRule parses "pattern[,pattern...]=action[@ttl][:args]", where args are
+// the comma-separated addresses of spoof or the ";"-separated records of static
+// (e.g., "=printer.lan=static@1h:A 192.168.1.10;TXT \"office\""). The TTL is
+// in seconds or a duration.
+func ParseRule(s string) (Rule, error) {
+	// Patterns may contain "=" themselves (exact names): split at the first
+	// "=" that is followed by a known action
+	var rule Rule
+	var patterns, args, ttl string
+	for i := strings.Index(s, "="); i >= 0; i = nextIndex(s, "=", i) {
+		token, rest, _ := strings.Cut(s[i+1:], ":")
+		action, t, _ := strings.Cut(token, "@")
+		switch action {
+		case ActionSpoof, ActionForward, ActionNXDomain, ActionSinkhole, ActionStatic:
+			patterns, rule.Action, args, ttl = s[:i], action, rest, t
+		}
+		if rule.Action != "" {
+			break
+		}
+	}
+	if rule.Action == "" {
+		return Rule{}, fmt.Errorf("invalid rule %q, expected pattern[,pattern...]=spoof|forward|nxdomain|sinkhole|static[@ttl][:args]", s)
+	}
+	if ttl != "" {
+		var err error
+		if rule.TTL, err = parseTTL(ttl); err != nil {
+			return Rule{}, fmt.Errorf("rule %q: %w", s, err)
+		}
+	}
+
+	for _, pattern := range match.SplitList(patterns) {
+		if _, err := match.Parse(pattern); err != nil {
+			return Rule{}, fmt.Errorf("rule %q: %w", s, err)
+		}
+		rule.Patterns = append(rule.Patterns, pattern)
+	}
+	if len(rule.Patterns) == 0 {
+		return Rule{}, fmt.Errorf("rule %q needs at least one pattern", s)
+	}
+
+	switch rule.Action {
+	case ActionSpoof:
+		var err error
+		if rule.IPs, err = ParseIPs(args); err != nil {
+			return Rule{}, fmt.Errorf("rule %q: %w", s, err)
+		}
+	case ActionStatic:
+		var cname bool
+		for _, record := range strings.Split(args, ";") {
+			if record = strings.TrimSpace(record); record == "" {
+				continue
+			}
+			rr, err := parseStaticRecord(record)
+			if err != nil {
+				return Rule{}, fmt.Errorf("rule %q: %w", s, err)
+			}
+			cname = cname || rr.Header().Rrtype == dns.TypeCNAME
+			rule.Records = append(rule.Records, record)
+		}
+		if len(rule.Records) == 0 {
+			return Rule{}, fmt.Errorf("rule %q needs at least one static record", s)
+		}
+		if cname && len(rule.Records) > 1 {
+			return Rule{}, fmt.Errorf("rule %q: a CNAME must be the only static record", s)
+		}
+	default:
+		if args != "" {
+			return Rule{}, fmt.Errorf("rule %q: %s takes no arguments", s, rule.Action)
+		}
+	}
+	return rule, nil
+}
+
+// parseTTL parses a TTL in seconds ("300") or as a duration ("5m")
+func parseTTL(s string) (time.Duration, error) {
+	ttl, err := time.ParseDuration(s)
+	if err != nil {
+		secs, convErr := strconv.ParseUint(s, 10, 31)
+		if convErr != nil {
+			return 0, fmt.Errorf("invalid TTL %q", s)
+		}
+		ttl = time.Duration(secs) * time.Second
+	}
+	if ttl < time.Second || ttl > math.MaxInt32*time.Second {
+		return 0, fmt.Errorf("TTL %q out of range", s)
+	}
+	return ttl, nil
+}
+
+// nextIndex returns the index of the next sep in s after i, or -1
+func nextIndex(s, sep string, i int) int {
+	if j := strings.Index(s[i+1:], sep); j >= 0 {
+		return i + 1 + j
+	}
+	return -1
+}
+
+// parseStaticRecord parses record data such as "A 192.0.2.1" into a record
+// with a placeholder owner, replaced by the query name when answering
+func parseStaticRecord(record string) (dns.RR, error) {
+	rr, err := dns.NewRR(fmt.Sprintf("static. %d IN %s", localTTL, record))
+	if err != nil {
+		return nil, fmt.Errorf("invalid static record %q: %w", record, err)
+	}
+	if rr == nil {
+		return nil, fmt.Errorf("empty static record %q", record)
+	}
+	return rr, nil
+}
+
+// rule is the action of one pattern
+type rule struct {
+	zone    string // Name the pattern is anchored at, used for synthetic SOA records ("" for globs and regexps)
+	action  string
+	addrs   *spoofAddrs // ActionSpoof and ActionSinkhole
+	records []dns.RR    // ActionStatic
+	ttl     uint32      // TTL of answers in seconds, localTTL if 0
+}
+
+// answerTTL returns the TTL of the rule's answers
+func (r *rule) answerTTL() uint32 {
+	if r.ttl == 0 {
+		return localTTL
+	}
+	return r.ttl
+}
+
+// soa returns the synthetic SOA for negative answers to name, with the
+// rule's TTL as negative caching time if set
+func (r *rule) soa(name string) *dns.SOA {
+	zone := r.zone
+	if zone == "" {
+		zone = name
+	}
+	soa := syntheticSOA(zone)
+	if r.ttl != 0 {
+		soa.Hdr.Ttl, soa.Minttl = r.ttl, r.ttl
+	}
+	return soa
+}
+
+// newRules builds the rule matcher from the explicit rules, the per-pattern
+// spoof targets and the default spoof patterns/addresses, in that order of
+// precedence for identical patterns. Rules without a TTL get ttl seconds.
+// Invalid patterns are logged and skipped.
+func newRules(rules []Rule, patterns []string, ips []net.IP, targets []SpoofTarget, ttl uint32) *match.Matcher[*rule] {
+	m := match.New[*rule]()
+	add := func(patterns []string, proto rule) {
+		for _, pattern := range patterns {
+			if strings.TrimSpace(pattern) == "" {
+				continue
+			}
+			p, err := match.Parse(pattern)
+			if err != nil {
+				log.Printf("[DNS] Ignoring rule pattern: %v", err)
+				continue
+			}
+			r := proto
+			r.zone = p.Zone()
+			m.AddPattern(p, &r)
+		}
+	}
+
+	defaults := newSpoofAddrs(ips)
+	for _, r := range rules {
+		proto := rule{action: r.Action, ttl: ttl}
+		if r.TTL > 0 {
+			proto.ttl = uint32(r.TTL / time.Second)
+		}
+		switch r.Action {
+		case ActionSpoof:
+			proto.addrs = defaults
+			if len(r.IPs) > 0 {
+				proto.addrs = newSpoofAddrs(r.IPs)
+			}
+		case ActionSinkhole:
+			proto.addrs = sinkholeAddrs
+		case ActionStatic:
+			for _, record := range r.Records {
+				rr, err := parseStaticRecord(record)
+				if err != nil {
+					log.Printf("[DNS] Ignoring static record: %v", err)
+					continue
+				}
+				rr.Header().Ttl = proto.answerTTL()
+				proto.records = append(proto.records, rr)
+			}
+		}
+		add(r.Patterns, proto)
+	}
+	for _, target := range targets {
+		add(target.Suffixes, rule{action: ActionSpoof, addrs: newSpoofAddrs(target.IPs), ttl: ttl})
+	}
+	add(patterns, rule{action: ActionSpoof, addrs: defaults, ttl: ttl})
+	return m
+}
+
+// matchRule returns the rule for name, or nil if no rule matches
+func (s *Server) matchRule(name string) *rule {
+	r, _ := s.rules.Match(name)
+	return r
+}
+
+// shouldSpoof checks if the domain should be spoofed
+func (s *Server) shouldSpoof(name string) bool {
+	r := s.matchRule(name)
+	return r != nil && r.action == ActionSpoof
+}
+
+// ProxyTarget reports whether the proxy should accept connections for name,
+// spoofed directly or a recent alias (CNAME) of a spoofed name, and returns
+// the name to resolve for the backend: name itself, or the spoofed name the
+// alias led to, so an alias cannot be re-pointed at an arbitrary host
+func (s *Server) ProxyTarget(name string) (string, bool) {
+	if s.shouldSpoof(name) {
+		return name, true
+	}
+	if via, ok := s.aliases.lookup(name, time.Now()); ok && s.shouldSpoof(via) {
+		return via, true
+	}
+	return "", false
+}
+
+// staticReply answers the query from the records of a static rule: records of
+// the queried type (or a CNAME) with the query name as owner, NODATA otherwise
+func staticReply(m *dns.Msg, q dns.Question, r *rule) {
+	for _, rr := range r.records {
+		t := rr.Header().Rrtype
+		if t != q.Qtype && t != dns.TypeCNAME && q.Qtype != dns.TypeANY {
+			continue
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Name = q.Name
+		m.Answer = append(m.Answer, rr)
+	}
+	log.Printf("[DNS] Static answer %s (type %s) -> %d records", q.Name, dns.TypeToString[q.Qtype], len(m.Answer))
+}
@@ -2,201 +2,743 @@ package dns
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
-	"strings"
+	"net/http"
 	"sync"
 	"time"
 
 	"github.com/miekg/dns"
+
+	"DnsSpoofer/internal/match"
 )
 
+// staleAnswerTimeout is how long a query waits for upstreams before an expired
+// cache entry is served instead (client response timer, RFC 8767 section 5)
+const staleAnswerTimeout = 1800 * time.Millisecond
+
 // Config holds DNS server configuration
 type Config struct {
-	ListenAddr      string        // Address to listen on (e.g., ":53")
-	SpoofIP         net.IP        // IP to return for spoofed domains
-	SpoofSuffixes   []string      // Domain suffixes to spoof (e.g., ".openai.com")
-	UpstreamDNS     []string      // Upstream DNS servers (e.g., ["8.8.8.8:53", "1.1.1.1:53"])
-	UpstreamTimeout time.Duration // Timeout for upstream queries
+	ListenAddr       string        // Address to listen on (e.g., ":53")
+	SpoofIPs         []net.IP      // Default IPs (IPv4 and/or IPv6) to return for spoofed domains
+	SpoofIPv4        []net.IP      // IPv4 addresses for spoofed A answers, replacing the IPv4 addresses of SpoofIPs
+	SpoofIPv6        []net.IP      // IPv6 addresses for spoofed AAAA answers, replacing the IPv6 addresses of SpoofIPs
+	SpoofSuffixes    []string      // Name patterns to spoof (e.g., ".openai.com", "!www.bing.com", see package match)
+	SpoofTargets     []SpoofTarget // Per-pattern spoof addresses, overriding SpoofIPs (most specific pattern wins)
+	Rules            []Rule        // Per-pattern actions (spoof, forward, nxdomain, sinkhole, static), checked with the spoof patterns
+	SpoofNetworks    []*net.IPNet  // Forwarded A/AAAA answers resolving into these networks are spoofed to SpoofIPs
+	SpoofTTL         time.Duration // TTL of spoofed answers unless a rule sets one (default 60s)
+	UpstreamDNS      []string      // Upstream DNS servers (e.g., ["8.8.8.8:53", "tls://1.1.1.1", "https://dns.google/dns-query"])
+	UpstreamTimeout  time.Duration // Timeout for upstream queries
+	UpstreamStrategy string        // Upstream selection: "sequential" (default), "parallel", "fastest" or "round-robin"
+	ForwardRules     []ForwardRule // Per-suffix upstreams, checked before UpstreamDNS (longest suffix wins)
+	TCPIdleTimeout   time.Duration // Idle timeout between queries on a TCP connection (RFC 7766)
+	DoTListenAddr    string        // Address for DNS-over-TLS (e.g., ":853"), disabled if empty
+	DoHListenAddr    string        // Address for DNS-over-HTTPS (e.g., ":8443"), disabled if empty
+	TLSCertFile      string        // TLS certificate file for encrypted listeners
+	TLSKeyFile       string        // TLS private key file for encrypted listeners
+	BootstrapDNS     string        // Plain DNS server used to resolve DoT/DoH upstream hostnames (avoids loops)
+	CacheSize        int           // Maximum number of cached upstream responses (0 disables caching)
+	ServeStale       time.Duration // How long expired entries may be answered when upstreams fail (RFC 8767), 0 disables
+	MinTTL           time.Duration // Lower bound for record TTLs of upstream answers, 0 keeps them
+	MaxTTL           time.Duration // Upper bound for record TTLs of upstream answers, 0 keeps them
+	PrefetchHits     int           // Hits within TTL after which an entry is refreshed before expiry (0 disables prefetch)
+	DenyClients      []*net.IPNet  // Clients that are always refused
+	SpoofClients     []*net.IPNet  // Clients that get spoofed answers (everyone not denied if both allow lists are empty)
+	ForwardClients   []*net.IPNet  // Clients that only get plain forwarding, never spoofed answers
+	ClientQueryRate  float64       // Queries per second per client /24 (IPv4) or /56 (IPv6), 0 disables
+	ClientQueryBurst int           // Queries a client prefix may send at once above ClientQueryRate
+	RRLRate          float64       // Identical UDP responses per second per client prefix (response rate limiting), 0 disables
+	RRLSlip          int           // Every Nth rate-limited response is sent truncated instead of dropped (0 never)
+	ECSPolicy        string        // EDNS Client Subnet on forwarded queries: "strip" (default), "pass" or "replace"
+	ECSSubnet        *net.IPNet    // Subnet sent upstream with the "replace" policy (e.g., the server's own /24)
+	HTTPSRecords     string        // HTTPS/SVCB answers for spoofed names: HTTPSNoData (default) or HTTPSRewrite
+	DNSSEC           bool          // Validate forwarded answers from the root trust anchor: AD if secure, SERVFAIL if bogus
+	RPZ              []RPZ         // Response policy zones, checked after rules and spoof patterns and before blocklists (first zone wins)
+	BlockDoH         bool          // Answer DoH canaries with NXDOMAIN and sinkhole public DoH/DoT resolvers, so clients keep using us
+	DoHResolvers     []string      // Extra DoH/DoT resolver name patterns for BlockDoH ("!pattern" keeps a built-in one)
+	Blocklists       []Blocklist   // Hosts/adblock lists checked before forwarding (names with a rule are never blocked)
+	BlocklistAllow   []string      // Name patterns never blocked by any list
+	BlocklistAction  string        // Answer for blocked names: ActionNXDomain (default) or ActionSinkhole
 }
 
 // Server is a DNS server that spoofs specific domains
 type Server struct {
-	config     Config
-	udpServer  *dns.Server
-	client     *dns.Client
-	shutdownCh chan struct{}
-	wg         sync.WaitGroup
+	config        Config
+	rules         *match.Matcher[*rule]
+	spoofNetAddrs *spoofAddrs // Addresses for answers in SpoofNetworks
+	udpServer     *dns.Server
+	tcpServer     *dns.Server
+	tlsServer     *dns.Server
+	dohServer     *http.Server
+	upstreams     *upstreamPool
+	forwardZones  []forwardZone
+	cache         *cache
+	validator     *validator                    // nil unless DNSSEC validation is enabled
+	bypass        *match.Matcher[*bypassPolicy] // nil unless BlockDoH is set
+	rpz           []*rpzZone
+	blocklists    []*blocklist
+	aliases       aliasSet // Names answered through a CNAME into a spoofed name
+	blockAllow    *match.Matcher[struct{}]
+	blockRule     *rule // Answer for blocked names
+	inflight      flightGroup
+	limits        rateLimiter
+	cookieSecret  []byte // Key for DNS server cookies (RFC 7873)
+	shutdownCh    chan struct{}
+	wg            sync.WaitGroup
 }
 
 // New creates a new DNS server
 func New(cfg Config) *Server {
-	// Normalize suffixes to lowercase
-	suffixes := make([]string, len(cfg.SpoofSuffixes))
-	for i, s := range cfg.SpoofSuffixes {
-		suffixes[i] = strings.ToLower(s)
-	}
-	cfg.SpoofSuffixes = suffixes
-
 	if cfg.UpstreamTimeout == 0 {
 		cfg.UpstreamTimeout = 5 * time.Second
 	}
+	if cfg.ECSPolicy == "" {
+		cfg.ECSPolicy = ECSStrip
+	}
+	if cfg.TCPIdleTimeout == 0 {
+		cfg.TCPIdleTimeout = 10 * time.Second
+	}
+	if cfg.SpoofTTL == 0 {
+		cfg.SpoofTTL = localTTL * time.Second
+	}
+	if cfg.HTTPSRecords == "" {
+		cfg.HTTPSRecords = HTTPSNoData
+	}
+	if cfg.BlocklistAction == "" {
+		cfg.BlocklistAction = ActionNXDomain
+	}
+	if len(cfg.SpoofIPv4) > 0 {
+		cfg.SpoofIPs = replaceFamily(cfg.SpoofIPs, cfg.SpoofIPv4, true)
+	}
+	if len(cfg.SpoofIPv6) > 0 {
+		cfg.SpoofIPs = replaceFamily(cfg.SpoofIPs, cfg.SpoofIPv6, false)
+	}
 
-	return &Server{
-		config:     cfg,
-		client:     &dns.Client{Timeout: cfg.UpstreamTimeout},
-		shutdownCh: make(chan struct{}),
+	s := &Server{
+		config:        cfg,
+		rules:         newRules(cfg.Rules, cfg.SpoofSuffixes, cfg.SpoofIPs, cfg.SpoofTargets, uint32(cfg.SpoofTTL/time.Second)),
+		spoofNetAddrs: newSpoofAddrs(cfg.SpoofIPs),
+		rpz:           newRPZZones(cfg.RPZ),
+		blocklists:    newBlocklists(cfg.Blocklists),
+		blockAllow:    newPatternSet(cfg.BlocklistAllow),
+		blockRule:     &rule{action: cfg.BlocklistAction, addrs: sinkholeAddrs},
+		cookieSecret:  newCookieSecret(),
+		shutdownCh:    make(chan struct{}),
 	}
+	if cfg.ClientQueryRate > 0 {
+		s.limits.queries = newLimiter(cfg.ClientQueryRate, cfg.ClientQueryBurst)
+	}
+	if cfg.RRLRate > 0 {
+		s.limits.responses = newLimiter(cfg.RRLRate, int(cfg.RRLRate))
+		s.limits.slip = uint64(max(cfg.RRLSlip, 0))
+	}
+	if cfg.CacheSize > 0 {
+		s.cache = newCache(cfg.CacheSize, cfg.ServeStale, cfg.PrefetchHits)
+	}
+	if cfg.BlockDoH {
+		s.bypass = newBypassRules(cfg.DoHResolvers)
+	}
+	if cfg.DNSSEC {
+		s.validator = newValidator(s.dnssecLookup, forwardSuffixes(cfg.ForwardRules))
+	}
+	return s
 }
 
-// shouldSpoof checks if the domain should be spoofed
-func (s *Server) shouldSpoof(name string) bool {
-	// Normalize: lowercase and remove trailing dot
-	name = strings.ToLower(strings.TrimSuffix(name, "."))
+// handleRequest handles incoming DNS requests. Every message gets exactly one
+// response: an error, a locally generated (spoofed) answer or the upstream answer.
+func (s *Server) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
+	ip := clientIP(w)
+	if !s.limits.allowQuery(ip, time.Now()) {
+		// Over UDP the query is dropped silently, stream clients get REFUSED
+		if isUDP(w) {
+			return
+		}
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		s.writeResponse(w, r, m)
+		return
+	}
+
+	if m := checkRequest(r); m != nil {
+		s.writeResponse(w, r, m)
+		return
+	}
 
-	for _, suffix := range s.config.SpoofSuffixes {
-		// Remove leading dot from suffix for comparison
-		cleanSuffix := strings.TrimPrefix(suffix, ".")
+	q := r.Question[0]
+	log.Printf("[DNS] Query: %s (type %s) from %s", q.Name, dns.TypeToString[q.Qtype], ip)
 
-		// Match exact domain or subdomain
-		if name == cleanSuffix || strings.HasSuffix(name, "."+cleanSuffix) {
-			return true
+	acc := s.clientAccess(ip)
+	if acc == accessRefused {
+		log.Printf("[DNS] Client %s not allowed -> REFUSED", ip)
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		s.writeResponse(w, r, m)
+		return
+	}
+
+	if acc == accessFull {
+		if m := s.spoofReply(r); m != nil {
+			s.writeResponse(w, r, m)
+			return
 		}
 	}
-	return false
+	// DoH countermeasures, response policy zones, then blocklists; RPZ
+	// PASSTHRU skips the blocklists
+	m := s.bypassReply(r)
+	if m == nil {
+		var matched bool
+		if m, matched = s.rpzReply(r); !matched {
+			m = s.blockReply(r)
+		}
+	}
+	if m != nil {
+		s.writeResponse(w, r, m)
+		return
+	}
+	s.forwardToUpstream(w, r, acc == accessFull)
 }
 
-// handleRequest handles incoming DNS requests
-func (s *Server) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
+// checkRequest returns an error response for messages we do not serve:
+// non-QUERY opcodes get NOTIMP, messages without exactly one question or
+// with a malformed cookie get FORMERR (RFC 9619, RFC 7873), unknown EDNS
+// versions get BADVERS (RFC 6891) and zone transfers get REFUSED.
+// Returns nil otherwise.
+func checkRequest(r *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+
+	switch {
+	case r.Opcode != dns.OpcodeQuery:
+		log.Printf("[DNS] Unsupported opcode %s -> NOTIMP", dns.OpcodeToString[r.Opcode])
+		m.SetRcode(r, dns.RcodeNotImplemented)
+
+	case len(r.Question) != 1:
+		log.Printf("[DNS] Message with %d questions -> FORMERR", len(r.Question))
+		m.SetRcode(r, dns.RcodeFormatError)
+
+	case r.IsEdns0() != nil && r.IsEdns0().Version() != 0:
+		log.Printf("[DNS] EDNS version %d -> BADVERS", r.IsEdns0().Version())
+		m.SetRcode(r, dns.RcodeBadVers)
+
+	case malformedCookie(r):
+		log.Printf("[DNS] Malformed DNS cookie -> FORMERR")
+		m.SetRcode(r, dns.RcodeFormatError)
+
+	case r.Question[0].Qtype == dns.TypeAXFR || r.Question[0].Qtype == dns.TypeIXFR:
+		log.Printf("[DNS] Zone transfer for %s -> REFUSED", r.Question[0].Name)
+		m.SetRcode(r, dns.RcodeRefused)
+
+	default:
+		return nil
+	}
+	return m
+}
+
+// spoofReply builds the local answer for a query on a name with a rule
+// (spoof, sinkhole, NXDOMAIN or static records), or returns nil if the query
+// has to be forwarded upstream. r must carry exactly one question (see checkRequest).
+func (s *Server) spoofReply(r *dns.Msg) *dns.Msg {
+	q := r.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return nil
+	}
+	rule := s.matchRule(q.Name)
+	if rule == nil || rule.action == ActionForward {
+		return nil
+	}
+	if rule.action == ActionSpoof && (q.Qtype == dns.TypeHTTPS || q.Qtype == dns.TypeSVCB) && s.config.HTTPSRecords == HTTPSRewrite {
+		if m := s.svcbReply(r, rule); m != nil {
+			return m
+		}
+	}
+	return ruleReply(r, rule)
+}
+
+// ruleReply builds the local answer of rule for the query, or returns nil if
+// the query has to be forwarded upstream
+func ruleReply(r *dns.Msg, rule *rule) *dns.Msg {
+	q := r.Question[0]
+	addrs := rule.addrs
+	verb := "Spoofing"
+	if rule.action == ActionSinkhole {
+		verb = "Sinkholing"
+	}
+
 	m := new(dns.Msg)
 	m.SetReply(r)
 	m.Authoritative = false
+	m.AuthenticatedData = false // Our data is never DNSSEC-validated
 
-	for _, q := range r.Question {
-		log.Printf("[DNS] Query: %s (type %s)", q.Name, dns.TypeToString[q.Qtype])
-
-		if s.shouldSpoof(q.Name) {
-			// Spoof A and AAAA records for our domains
-			// Block HTTPS/SVCB to prevent QUIC/HTTP3 hints
-			switch q.Qtype {
-			case dns.TypeA:
-				log.Printf("[DNS] Spoofing %s -> %s", q.Name, s.config.SpoofIP)
-				rr := &dns.A{
-					Hdr: dns.RR_Header{
-						Name:   q.Name,
-						Rrtype: dns.TypeA,
-						Class:  dns.ClassINET,
-						Ttl:    60,
-					},
-					A: s.config.SpoofIP.To4(),
-				}
-				m.Answer = append(m.Answer, rr)
-
-			case dns.TypeAAAA:
-				// Return empty response for AAAA to force IPv4
-				// Or return IPv6 if SpoofIP is IPv6
-				if ip6 := s.config.SpoofIP.To16(); ip6 != nil && s.config.SpoofIP.To4() == nil {
-					rr := &dns.AAAA{
-						Hdr: dns.RR_Header{
-							Name:   q.Name,
-							Rrtype: dns.TypeAAAA,
-							Class:  dns.ClassINET,
-							Ttl:    60,
-						},
-						AAAA: ip6,
-					}
-					m.Answer = append(m.Answer, rr)
-				}
-				// If SpoofIP is IPv4, just return empty AAAA (no error, just no answer)
-				log.Printf("[DNS] Spoofing AAAA %s -> (empty, forcing IPv4)", q.Name)
-
-			case dns.TypeHTTPS, dns.TypeSVCB:
-				// Return NODATA for HTTPS/SVCB records to prevent QUIC/HTTP3 hints
-				// This forces clients to use TCP (HTTP/2 or HTTP/1.1) instead of QUIC
-				// Also prevents ECH (Encrypted Client Hello) keys from being delivered
-				log.Printf("[DNS] Blocking %s %s -> NODATA (preventing QUIC/ECH)", dns.TypeToString[q.Qtype], q.Name)
-				// Empty answer = NODATA response (RCODE=NOERROR, no answers)
-				// Client will fall back to A/AAAA records and TCP
+	switch {
+	case rule.action == ActionNXDomain:
+		log.Printf("[DNS] Rule %s -> NXDOMAIN", q.Name)
+		m.Rcode = dns.RcodeNameError
 
-			default:
-				// For other record types, forward to upstream
-				s.forwardToUpstream(w, r)
-				return
+	case rule.action == ActionStatic:
+		staticReply(m, q, rule)
+
+	// Spoof A and AAAA records for our domains
+	// Block HTTPS/SVCB to prevent QUIC/HTTP3 hints
+	case q.Qtype == dns.TypeA:
+		ips := addrs.rotate(addrs.v4)
+		if len(ips) == 0 {
+			log.Printf("[DNS] Spoofing A %s -> (empty, no IPv4 target)", q.Name)
+			break
+		}
+		log.Printf("[DNS] %s %s -> %v", verb, q.Name, ips)
+		for _, ip := range ips {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   q.Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    rule.answerTTL(),
+				},
+				A: ip,
+			})
+		}
+
+	case q.Qtype == dns.TypeAAAA:
+		// Return IPv6 targets if there are any, otherwise an empty response to force IPv4
+		ips := addrs.rotate(addrs.v6)
+		if len(ips) == 0 {
+			// Empty answer = NODATA (no error, just no answer)
+			log.Printf("[DNS] Spoofing AAAA %s -> (empty, forcing IPv4)", q.Name)
+			break
+		}
+		log.Printf("[DNS] %s AAAA %s -> %v", verb, q.Name, ips)
+		for _, ip := range ips {
+			m.Answer = append(m.Answer, &dns.AAAA{
+				Hdr: dns.RR_Header{
+					Name:   q.Name,
+					Rrtype: dns.TypeAAAA,
+					Class:  dns.ClassINET,
+					Ttl:    rule.answerTTL(),
+				},
+				AAAA: ip,
+			})
+		}
+
+	case q.Qtype == dns.TypeHTTPS || q.Qtype == dns.TypeSVCB:
+		// Return NODATA for HTTPS/SVCB records to prevent QUIC/HTTP3 hints
+		// This forces clients to use TCP (HTTP/2 or HTTP/1.1) instead of QUIC
+		// Also prevents ECH (Encrypted Client Hello) keys from being delivered
+		log.Printf("[DNS] Blocking %s %s -> NODATA (preventing QUIC/ECH)", dns.TypeToString[q.Qtype], q.Name)
+		// Client will fall back to A/AAAA records and TCP
+
+	case rule.action == ActionSinkhole:
+		log.Printf("[DNS] Sinkholing %s %s -> NODATA", dns.TypeToString[q.Qtype], q.Name)
+
+	default:
+		// For other record types (MX, TXT, CNAME, ...), forward to upstream
+		return nil
+	}
+
+	if len(m.Answer) == 0 {
+		// NODATA and NXDOMAIN carry the zone's SOA so clients cache them (RFC 2308)
+		m.Ns = append(m.Ns, rule.soa(q.Name))
+	}
+	return m
+}
+
+// forwardToUpstream answers the request from the cache or upstream DNS servers.
+// With DNSSEC enabled, answers for names we do not spoof and that are not
+// under a forward zone (negative trust anchors) are validated. If
+// spoof is set, answers whose CNAME chain enters a spoofed name or that
+// resolve into a spoofed network are spoofed.
+func (s *Server) forwardToUpstream(w dns.ResponseWriter, r *dns.Msg, spoof bool) {
+	name := r.Question[0].Name
+	validate := s.validator != nil && !s.shouldSpoof(name) && !s.validator.negativeAnchor(name)
+
+	q := s.upstreamQuery(r)
+	if validate {
+		q = dnssecQuery(q)
+	}
+	resp, err := s.resolve(q)
+	if err != nil {
+		// All upstreams failed
+		log.Printf("[DNS] All upstreams failed, last error: %v", err)
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		s.writeResponse(w, r, m)
+		return
+	}
+
+	if validate {
+		if err := s.secureResponse(r, resp); err != nil {
+			log.Printf("[DNS] DNSSEC validation failed for %s: %v -> SERVFAIL", name, err)
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeServerFailure)
+			if errors.Is(err, errBogus) {
+				// Extended DNS Error (RFC 8914), dropped by setEDNS for non-EDNS clients
+				m.SetEdns0(ednsUDPSize, false)
+				opt := m.IsEdns0()
+				opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeDNSBogus})
 			}
-		} else {
-			// Forward non-spoofed domains to upstream
-			s.forwardToUpstream(w, r)
+			s.writeResponse(w, r, m)
 			return
 		}
+	} else if s.validator != nil {
+		resp.AuthenticatedData = false // Never vouch for names we spoof
 	}
 
-	if err := w.WriteMsg(m); err != nil {
-		log.Printf("[DNS] Error writing response: %v", err)
+	chained := spoof && (s.spoofChain(r, resp) || s.spoofRanges(r, resp))
+	if !chained {
+		if m := s.rpzResponse(r, resp); m != nil {
+			s.writeResponse(w, r, m)
+			return
+		}
+	}
+
+	// The client only sees ECS if its own option was passed through
+	if opt := resp.IsEdns0(); opt != nil && (s.config.ECSPolicy != ECSPass || chained || s.shouldSpoof(name)) {
+		opt.Option = removeOption(opt.Option, dns.EDNS0SUBNET)
 	}
+
+	s.writeResponse(w, r, resp)
 }
 
-// forwardToUpstream forwards the request to upstream DNS servers
-func (s *Server) forwardToUpstream(w dns.ResponseWriter, r *dns.Msg) {
-	var lastErr error
+// resolve returns a response for r owned by the caller. Cacheable queries are
+// answered from the cache when possible, and concurrent identical queries
+// share a single upstream exchange.
+func (s *Server) resolve(r *dns.Msg) (*dns.Msg, error) {
+	key, cacheable := newCacheKey(r)
+	if !cacheable {
+		return s.exchange(r)
+	}
 
-	for _, upstream := range s.config.UpstreamDNS {
-		log.Printf("[DNS] Forwarding to upstream %s", upstream)
+	var stale *dns.Msg
+	if s.cache != nil {
+		resp, status := s.cache.get(key, time.Now())
+		switch status {
+		case cacheFresh:
+			log.Printf("[DNS] Cache hit: %s (type %s)", r.Question[0].Name, dns.TypeToString[key.qtype])
+			return replyFor(r, resp), nil
+		case cachePrefetch:
+			log.Printf("[DNS] Cache hit: %s (type %s), prefetching", r.Question[0].Name, dns.TypeToString[key.qtype])
+			go s.refresh(key, r.Copy())
+			return replyFor(r, resp), nil
+		case cacheStale:
+			stale = resp
+		}
+	}
 
-		resp, _, err := s.client.Exchange(r, upstream)
+	if stale == nil {
+		resp, err := s.refresh(key, r)
 		if err != nil {
-			log.Printf("[DNS] Upstream %s error: %v", upstream, err)
-			lastErr = err
-			continue
+			return nil, err
 		}
+		return replyFor(r, resp.Copy()), nil
+	}
+
+	// Serve-stale (RFC 8767): try to refresh, but answer from the expired
+	// entry if the upstreams fail or take too long; the refresh keeps
+	// running in the background and updates the cache
+	type result struct {
+		resp *dns.Msg
+		err  error
+	}
+	done := make(chan result, 1)
+	go func(r *dns.Msg) {
+		resp, err := s.refresh(key, r)
+		done <- result{resp, err}
+	}(r.Copy())
 
-		if err := w.WriteMsg(resp); err != nil {
-			log.Printf("[DNS] Error writing upstream response: %v", err)
+	select {
+	case res := <-done:
+		if res.err == nil && res.resp.Rcode != dns.RcodeServerFailure {
+			return replyFor(r, res.resp.Copy()), nil
 		}
-		return
+		log.Printf("[DNS] Serving stale %s after upstream failure (error: %v)", r.Question[0].Name, res.err)
+	case <-time.After(staleAnswerTimeout):
+		log.Printf("[DNS] Serving stale %s while refreshing", r.Question[0].Name)
+	}
+	s.cache.staleServed.Add(1)
+	return replyFor(r, stale), nil
+}
+
+// refresh queries the upstreams for r and updates the cache. Concurrent
+// refreshes of the same key share one upstream exchange; the returned
+// message is shared and must not be modified.
+func (s *Server) refresh(key cacheKey, r *dns.Msg) (*dns.Msg, error) {
+	return s.inflight.do(key, func() (*dns.Msg, error) {
+		resp, err := s.exchange(r)
+		if err == nil && s.cache != nil {
+			s.cache.set(key, resp, time.Now())
+		}
+		return resp, err
+	})
+}
+
+// replyFor adapts a cached or shared response to the request r
+func replyFor(r, resp *dns.Msg) *dns.Msg {
+	resp.Id = r.Id
+	resp.Question = r.Question
+	return resp
+}
+
+// exchange forwards r to the upstream DNS servers responsible for its name
+func (s *Server) exchange(r *dns.Msg) (*dns.Msg, error) {
+	resp, err := s.poolFor(r).exchange(r)
+	if err == nil && (s.config.MinTTL > 0 || s.config.MaxTTL > 0) {
+		clampTTL(resp, uint32(s.config.MinTTL/time.Second), uint32(s.config.MaxTTL/time.Second))
+	}
+	return resp, err
+}
+
+// writeResponse writes the response for request r to the client, with EDNS0
+// matching the request (see setEDNS). Over UDP responses are subject to
+// response rate limiting, unless the client proved its address with a valid
+// server cookie, and are truncated to the client's advertised buffer size
+// (TC bit set, so the client retries over TCP). Over TCP the
+// edns-tcp-keepalive option is echoed when the client asked for it (RFC 7828).
+func (s *Server) writeResponse(w dns.ResponseWriter, r, m *dns.Msg) {
+	ip := clientIP(w)
+	now := time.Now()
+	udp := isUDP(w)
+
+	if udp && !s.validCookie(r, ip, now) {
+		switch s.limits.checkResponse(ip, m, now) {
+		case rrlDrop:
+			return
+		case rrlSlip:
+			// Empty truncated reply: real clients retry over TCP, reflection gets nothing
+			slip := new(dns.Msg)
+			slip.SetReply(r)
+			slip.Rcode = m.Rcode
+			slip.Truncated = true
+			m = slip
+		}
+	}
+
+	s.setEDNS(r, m, ip)
+	if udp {
+		m.Truncate(udpBufferSize(r))
+	} else if wantsKeepalive(r) {
+		opt := m.IsEdns0() // Present, the request used EDNS
+		opt.Option = append(removeOption(opt.Option, dns.EDNS0TCPKEEPALIVE), &dns.EDNS0_TCP_KEEPALIVE{
+			Code:    dns.EDNS0TCPKEEPALIVE,
+			Timeout: uint16(s.config.TCPIdleTimeout / (100 * time.Millisecond)),
+		})
 	}
 
-	// All upstreams failed
-	log.Printf("[DNS] All upstreams failed, last error: %v", lastErr)
-	m := new(dns.Msg)
-	m.SetRcode(r, dns.RcodeServerFailure)
 	if err := w.WriteMsg(m); err != nil {
-		log.Printf("[DNS] Error writing SERVFAIL: %v", err)
+		log.Printf("[DNS] Error writing response: %v", err)
+	}
+}
+
+// isUDP reports whether the response goes back over UDP
+func isUDP(w dns.ResponseWriter) bool {
+	_, ok := w.RemoteAddr().(*net.UDPAddr)
+	return ok
+}
+
+// udpBufferSize returns the UDP payload size of the response: the client's
+// EDNS0 buffer size capped at our own ednsUDPSize, so answers are never
+// fragmented (RFC 9715), and 512 bytes without EDNS0 (RFC 1035)
+func udpBufferSize(r *dns.Msg) int {
+	if opt := r.IsEdns0(); opt != nil {
+		return max(min(int(opt.UDPSize()), ednsUDPSize), dns.MinMsgSize)
+	}
+	return dns.MinMsgSize
+}
+
+// wantsKeepalive reports whether the client sent the edns-tcp-keepalive option
+func wantsKeepalive(r *dns.Msg) bool {
+	opt := r.IsEdns0()
+	return opt != nil && hasOption(opt, dns.EDNS0TCPKEEPALIVE)
+}
+
+// hasOption reports whether the OPT record carries an option with the given code
+func hasOption(opt *dns.OPT, code uint16) bool {
+	for _, o := range opt.Option {
+		if o.Option() == code {
+			return true
+		}
+	}
+	return false
+}
+
+// removeOPT returns the records without the OPT pseudo-record
+func removeOPT(extra []dns.RR) []dns.RR {
+	out := extra[:0]
+	for _, rr := range extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// removeOption returns options without the ones with the given code
+func removeOption(options []dns.EDNS0, code uint16) []dns.EDNS0 {
+	out := options[:0]
+	for _, o := range options {
+		if o.Option() != code {
+			out = append(out, o)
+		}
 	}
+	return out
 }
 
-// Start starts the DNS server
+// Start starts the DNS server (UDP and TCP on the same address, plus DoT/DoH if configured)
 func (s *Server) Start() error {
+	if err := checkECSConfig(s.config); err != nil {
+		return err
+	}
+
+	dialer := newBootstrapDialer(s.config.BootstrapDNS, s.config.UpstreamTimeout)
+	newPool := func(addrs []string) (*upstreamPool, error) {
+		return newUpstreamPool(addrs, s.config.UpstreamStrategy, s.config.UpstreamTimeout, dialer)
+	}
+
+	upstreams, err := newPool(s.config.UpstreamDNS)
+	if err != nil {
+		return err
+	}
+	s.upstreams = upstreams
+
+	s.forwardZones, err = newForwardZones(s.config.ForwardRules, newPool)
+	if err != nil {
+		return err
+	}
+
+	handler := dns.HandlerFunc(s.handleRequest)
+
 	s.udpServer = &dns.Server{
 		Addr:    s.config.ListenAddr,
 		Net:     "udp",
-		Handler: dns.HandlerFunc(s.handleRequest),
+		Handler: handler,
+		UDPSize: dns.DefaultMsgSize,
+	}
+	s.tcpServer = &dns.Server{
+		Addr:    s.config.ListenAddr,
+		Net:     "tcp",
+		Handler: handler,
+		IdleTimeout: func() time.Duration {
+			return s.config.TCPIdleTimeout
+		},
 	}
 
+	var certs *certReloader
+	if s.config.DoTListenAddr != "" || s.config.DoHListenAddr != "" {
+		var err error
+		certs, err = newCertReloader(s.config.TLSCertFile, s.config.TLSKeyFile)
+		if err != nil {
+			return fmt.Errorf("TLS certificate: %w", err)
+		}
+	}
+
+	if s.config.DoTListenAddr != "" {
+		s.tlsServer = &dns.Server{
+			Addr:      s.config.DoTListenAddr,
+			Net:       "tcp-tls",
+			Handler:   handler,
+			TLSConfig: certs.tlsConfig(),
+			IdleTimeout: func() time.Duration {
+				return s.config.TCPIdleTimeout
+			},
+		}
+	}
+
+	s.serve("UDP", s.udpServer)
+	s.serve("TCP", s.tcpServer)
+	if s.tlsServer != nil {
+		s.serve("DoT", s.tlsServer)
+	}
+
+	if s.config.DoHListenAddr != "" {
+		s.dohServer = &http.Server{
+			Addr:              s.config.DoHListenAddr,
+			Handler:           s.dohHandler(),
+			TLSConfig:         certs.tlsConfig(),
+			ReadHeaderTimeout: 5 * time.Second,
+			IdleTimeout:       s.config.TCPIdleTimeout,
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			log.Printf("[DNS] Starting DoH server on %s%s", s.config.DoHListenAddr, dohPath)
+			if err := s.dohServer.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+				log.Printf("[DNS] DoH server error: %v", err)
+			}
+		}()
+	}
+
+	return nil
+}
+
+// serve runs srv in the background until Shutdown
+func (s *Server) serve(name string, srv *dns.Server) {
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
-		log.Printf("[DNS] Starting UDP server on %s", s.config.ListenAddr)
-		if err := s.udpServer.ListenAndServe(); err != nil {
+		log.Printf("[DNS] Starting %s server on %s", name, srv.Addr)
+		if err := srv.ListenAndServe(); err != nil {
 			select {
 			case <-s.shutdownCh:
 				// Expected shutdown
 			default:
-				log.Printf("[DNS] Server error: %v", err)
+				log.Printf("[DNS] %s server error: %v", name, err)
 			}
 		}
 	}()
+}
 
-	return nil
+// CacheStats holds cache counters
+type CacheStats struct {
+	Hits        uint64 // Queries answered from fresh entries
+	Misses      uint64 // Queries not found in the cache
+	StaleServed uint64 // Queries answered from expired entries (serve-stale)
+	Prefetches  uint64 // Entries refreshed before expiry
+	Size        int    // Current number of entries
+}
+
+// CacheStats returns the cache counters
+func (s *Server) CacheStats() CacheStats {
+	if s.cache == nil {
+		return CacheStats{}
+	}
+	return CacheStats{
+		Hits:        s.cache.hits.Load(),
+		Misses:      s.cache.misses.Load(),
+		StaleServed: s.cache.staleServed.Load(),
+		Prefetches:  s.cache.prefetches.Load(),
+		Size:        s.cache.Len(),
+	}
+}
+
+// UpstreamStats returns health, latency and error counters of each upstream,
+// including the upstreams of forward rules
+func (s *Server) UpstreamStats() []UpstreamStats {
+	if s.upstreams == nil {
+		return nil
+	}
+	stats := s.upstreams.stats()
+	for _, zone := range s.forwardZones {
+		stats = append(stats, zone.pool.stats()...)
+	}
+	return stats
 }
 
 // Shutdown gracefully shuts down the DNS server
 func (s *Server) Shutdown(ctx context.Context) error {
 	close(s.shutdownCh)
 
-	if s.udpServer != nil {
-		if err := s.udpServer.ShutdownContext(ctx); err != nil {
-			return fmt.Errorf("DNS server shutdown: %w", err)
+	for _, srv := range []*dns.Server{s.udpServer, s.tcpServer, s.tlsServer} {
+		if srv == nil {
+			continue
+		}
+		if err := srv.ShutdownContext(ctx); err != nil {
+			return fmt.Errorf("DNS %s server shutdown: %w", srv.Net, err)
+		}
+	}
+	if s.dohServer != nil {
+		if err := s.dohServer.Shutdown(ctx); err != nil {
+			return fmt.Errorf("DoH server shutdown: %w", err)
 		}
 	}
 
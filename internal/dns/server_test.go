@@ -0,0 +1,297 @@
+package dns
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// testUpstream answers every forwarded A query with 192.0.2.53 and other
+// types with NODATA, counting the queries it gets
+type testUpstream struct {
+	queries atomic.Int32
+}
+
+func (u *testUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	u.queries.Add(1)
+	resp := new(dns.Msg)
+	resp.SetReply(m)
+	resp.RecursionAvailable = true
+	if q := m.Question[0]; q.Qtype == dns.TypeA {
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP("192.0.2.53"),
+		})
+	}
+	return resp, nil
+}
+
+func (u *testUpstream) String() string { return "test" }
+
+// newTestServer creates a server that forwards to up without listening
+func newTestServer(cfg Config, up upstream) *Server {
+	s := New(cfg)
+	s.upstreams = &upstreamPool{
+		strategy:  StrategySequential,
+		timeout:   time.Second,
+		upstreams: []*upstreamState{{upstream: up}},
+	}
+	return s
+}
+
+// testWriter is a dns.ResponseWriter recording the responses as a client
+// would receive them (packed and unpacked again)
+type testWriter struct {
+	t      *testing.T
+	remote net.Addr
+	msgs   []*dns.Msg
+}
+
+func newTestWriter(t *testing.T) *testWriter {
+	return &testWriter{t: t, remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.100"), Port: 5300}}
+}
+
+func (w *testWriter) LocalAddr() net.Addr  { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+func (w *testWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *testWriter) Close() error         { return nil }
+func (w *testWriter) TsigStatus() error    { return nil }
+func (w *testWriter) TsigTimersOnly(bool)  {}
+func (w *testWriter) Hijack()              {}
+
+func (w *testWriter) WriteMsg(m *dns.Msg) error {
+	buf, err := m.Pack()
+	if err != nil {
+		w.t.Fatalf("packing response: %v", err)
+	}
+	return w.unpack(buf)
+}
+
+func (w *testWriter) Write(buf []byte) (int, error) {
+	return len(buf), w.unpack(buf)
+}
+
+func (w *testWriter) unpack(buf []byte) error {
+	m := new(dns.Msg)
+	if err := m.Unpack(buf); err != nil {
+		w.t.Fatalf("unpacking response: %v", err)
+	}
+	w.msgs = append(w.msgs, m)
+	return nil
+}
+
+// exchange sends r to the server and returns its only response
+func exchange(t *testing.T, s *Server, r *dns.Msg) *dns.Msg {
+	t.Helper()
+	w := newTestWriter(t)
+	s.handleRequest(w, r)
+	if len(w.msgs) != 1 {
+		t.Fatalf("got %d responses, want exactly one", len(w.msgs))
+	}
+	if w.msgs[0].Id != r.Id {
+		t.Errorf("response ID %d, want %d", w.msgs[0].Id, r.Id)
+	}
+	return w.msgs[0]
+}
+
+// rdata returns the answer records as "TYPE data" strings
+func rdata(rrs []dns.RR) []string {
+	var out []string
+	for _, rr := range rrs {
+		h := rr.Header()
+		out = append(out, dns.TypeToString[h.Rrtype]+" "+strings.TrimPrefix(rr.String(), h.String()))
+	}
+	return out
+}
+
+func TestHandleRequestQtypes(t *testing.T) {
+	rules := []string{
+		"=static.test=static:A 192.0.2.10;TXT \"hello\"",
+		".nx.test=nxdomain",
+		".sink.test=sinkhole",
+		"=forward.spoof.test=forward",
+	}
+	cfg := Config{
+		SpoofIPs:      []net.IP{net.ParseIP("198.51.100.1")},
+		SpoofSuffixes: []string{".spoof.test"},
+		SpoofTargets: []SpoofTarget{{
+			Suffixes: []string{".v6.test"},
+			IPs:      []net.IP{net.ParseIP("198.51.100.2"), net.ParseIP("2001:db8::2")},
+		}},
+	}
+	for _, s := range rules {
+		rule, err := ParseRule(s)
+		if err != nil {
+			t.Fatalf("ParseRule(%q): %v", s, err)
+		}
+		cfg.Rules = append(cfg.Rules, rule)
+	}
+
+	tests := []struct {
+		name      string
+		qtype     uint16
+		rcode     int
+		answer    []string
+		forwarded bool
+	}{
+		// A: spoofed to the IPv4 address
+		{"www.spoof.test.", dns.TypeA, dns.RcodeSuccess, []string{"A 198.51.100.1"}, false},
+		{"www.v6.test.", dns.TypeA, dns.RcodeSuccess, []string{"A 198.51.100.2"}, false},
+		// AAAA: spoofed with an IPv6 target, NODATA (force IPv4) without
+		{"www.v6.test.", dns.TypeAAAA, dns.RcodeSuccess, []string{"AAAA 2001:db8::2"}, false},
+		{"www.spoof.test.", dns.TypeAAAA, dns.RcodeSuccess, nil, false},
+		// HTTPS/SVCB: NODATA, no QUIC hints or ECH keys
+		{"www.spoof.test.", dns.TypeHTTPS, dns.RcodeSuccess, nil, false},
+		{"www.spoof.test.", dns.TypeSVCB, dns.RcodeSuccess, nil, false},
+		// Other types of spoofed names and names without a rule are forwarded
+		{"www.spoof.test.", dns.TypeMX, dns.RcodeSuccess, nil, true},
+		{"www.spoof.test.", dns.TypeTXT, dns.RcodeSuccess, nil, true},
+		{"www.other.test.", dns.TypeA, dns.RcodeSuccess, []string{"A 192.0.2.53"}, true},
+		{"forward.spoof.test.", dns.TypeA, dns.RcodeSuccess, []string{"A 192.0.2.53"}, true},
+		// NXDOMAIN for every type
+		{"www.nx.test.", dns.TypeA, dns.RcodeNameError, nil, false},
+		{"www.nx.test.", dns.TypeMX, dns.RcodeNameError, nil, false},
+		// Sinkhole: unspecified addresses, NODATA for other types
+		{"www.sink.test.", dns.TypeA, dns.RcodeSuccess, []string{"A 0.0.0.0"}, false},
+		{"www.sink.test.", dns.TypeAAAA, dns.RcodeSuccess, []string{"AAAA ::"}, false},
+		{"www.sink.test.", dns.TypeTXT, dns.RcodeSuccess, nil, false},
+		// Static: records of the type, NODATA for other types
+		{"static.test.", dns.TypeA, dns.RcodeSuccess, []string{"A 192.0.2.10"}, false},
+		{"static.test.", dns.TypeTXT, dns.RcodeSuccess, []string{`TXT "hello"`}, false},
+		{"static.test.", dns.TypeMX, dns.RcodeSuccess, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"/"+dns.TypeToString[tt.qtype], func(t *testing.T) {
+			up := new(testUpstream)
+			s := newTestServer(cfg, up)
+			r := new(dns.Msg)
+			r.SetQuestion(tt.name, tt.qtype)
+
+			m := exchange(t, s, r)
+			if m.Rcode != tt.rcode {
+				t.Errorf("rcode %s, want %s", dns.RcodeToString[m.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if got := rdata(m.Answer); strings.Join(got, "|") != strings.Join(tt.answer, "|") {
+				t.Errorf("answer %q, want %q", got, tt.answer)
+			}
+			if forwarded := up.queries.Load() > 0; forwarded != tt.forwarded {
+				t.Errorf("forwarded %v, want %v", forwarded, tt.forwarded)
+			}
+			if !tt.forwarded && len(m.Answer) == 0 {
+				// Local negative answers carry a SOA for negative caching
+				if len(m.Ns) != 1 || m.Ns[0].Header().Rrtype != dns.TypeSOA {
+					t.Errorf("authority %v, want a SOA", m.Ns)
+				}
+			}
+			if len(m.Question) != 1 || m.Question[0] != r.Question[0] {
+				t.Errorf("question %v, want %v", m.Question, r.Question)
+			}
+		})
+	}
+}
+
+func TestHandleRequestErrors(t *testing.T) {
+	question := func(name string, qtype uint16) dns.Question {
+		return dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET}
+	}
+	tests := []struct {
+		name  string
+		msg   func(r *dns.Msg)
+		rcode int
+	}{
+		{"notify", func(r *dns.Msg) { r.Opcode = dns.OpcodeNotify }, dns.RcodeNotImplemented},
+		{"update", func(r *dns.Msg) { r.Opcode = dns.OpcodeUpdate }, dns.RcodeNotImplemented},
+		{"no question", func(r *dns.Msg) { r.Question = nil }, dns.RcodeFormatError},
+		{"two questions", func(r *dns.Msg) {
+			r.Question = append(r.Question, question("www.other.test.", dns.TypeA))
+		}, dns.RcodeFormatError},
+		{"two spoofed questions", func(r *dns.Msg) {
+			r.Question = append(r.Question, question("api.spoof.test.", dns.TypeAAAA))
+		}, dns.RcodeFormatError},
+		{"EDNS version 1", func(r *dns.Msg) {
+			r.SetEdns0(1232, false)
+			r.IsEdns0().SetVersion(1)
+		}, dns.RcodeBadVers},
+		{"malformed cookie", func(r *dns.Msg) {
+			r.SetEdns0(1232, false)
+			opt := r.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102"})
+		}, dns.RcodeFormatError},
+		{"AXFR", func(r *dns.Msg) { r.Question[0].Qtype = dns.TypeAXFR }, dns.RcodeRefused},
+		{"IXFR", func(r *dns.Msg) { r.Question[0].Qtype = dns.TypeIXFR }, dns.RcodeRefused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up := new(testUpstream)
+			s := newTestServer(Config{
+				SpoofIPs:      []net.IP{net.ParseIP("198.51.100.1")},
+				SpoofSuffixes: []string{".spoof.test"},
+			}, up)
+			r := new(dns.Msg)
+			r.SetQuestion("www.spoof.test.", dns.TypeA)
+			tt.msg(r)
+
+			m := exchange(t, s, r)
+			if m.Rcode != tt.rcode {
+				t.Errorf("rcode %s, want %s", dns.RcodeToString[m.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if len(m.Answer) != 0 {
+				t.Errorf("answer %v, want none", m.Answer)
+			}
+			if n := up.queries.Load(); n != 0 {
+				t.Errorf("%d queries forwarded, want none", n)
+			}
+		})
+	}
+}
+
+func TestUDPResponseSize(t *testing.T) {
+	var records []string
+	for i := 0; i < 16; i++ {
+		records = append(records, `TXT "`+strings.Repeat(string(rune('a'+i)), 200)+`"`)
+	}
+	rule, err := ParseRule("=big.test=static:" + strings.Join(records, ";"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(Config{Rules: []Rule{rule}}, new(testUpstream))
+
+	tests := []struct {
+		edns uint16 // Advertised buffer size, 0 for no EDNS
+		max  int
+	}{
+		{0, dns.MinMsgSize},
+		{256, dns.MinMsgSize},
+		{1000, 1000},
+		{1232, ednsUDPSize},
+		{4096, ednsUDPSize},
+		{65535, ednsUDPSize},
+	}
+	for _, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion("big.test.", dns.TypeTXT)
+		if tt.edns > 0 {
+			r.SetEdns0(tt.edns, false)
+		}
+		m := exchange(t, s, r)
+		buf, err := m.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(buf) > tt.max || !m.Truncated {
+			t.Errorf("EDNS %d: %d bytes, truncated %v; want at most %d, truncated", tt.edns, len(buf), m.Truncated, tt.max)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"DnsSpoofer/internal/match"
+)
+
+// SpoofTarget sends names matching Suffixes to their own addresses instead of
+// the default SpoofIPs (e.g., OpenAI to one proxy box, Gemini to another)
+type SpoofTarget struct {
+	Suffixes []string // Name patterns (e.g., ".openai.com", see package match)
+	IPs      []net.IP // IPv4 and/or IPv6 addresses returned for these suffixes
+}
+
+// ParseSpoofTarget parses "suffix[,suffix...]=ip[,ip...]"; patterns may
+// contain "=" themselves (exact names), the last one separates the addresses
+func ParseSpoofTarget(s string) (SpoofTarget, error) {
+	i := strings.LastIndex(s, "=")
+	if i < 0 {
+		return SpoofTarget{}, fmt.Errorf("invalid spoof target %q, expected suffix[,suffix...]=ip[,ip...]", s)
+	}
+	suffixes, ips := s[:i], s[i+1:]
+
+	target := SpoofTarget{Suffixes: match.SplitList(suffixes)}
+	var err error
+	if target.IPs, err = ParseIPs(ips); err != nil {
+		return SpoofTarget{}, fmt.Errorf("spoof target %q: %w", s, err)
+	}
+	if len(target.Suffixes) == 0 || len(target.IPs) == 0 {
+		return SpoofTarget{}, fmt.Errorf("spoof target %q needs at least one suffix and one IP", s)
+	}
+	return target, nil
+}
+
+// ParseIPs parses a comma-separated list of IP addresses
+func ParseIPs(s string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		ip := net.ParseIP(field)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP %q", field)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// replaceFamily returns ips with the IPv4 (or IPv6) addresses replaced by family
+func replaceFamily(ips, family []net.IP, v4 bool) []net.IP {
+	var out []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) != v4 {
+			out = append(out, ip)
+		}
+	}
+	for _, ip := range family {
+		if (ip.To4() != nil) == v4 {
+			out = append(out, ip)
+		}
+	}
+	return out
+}
+
+// spoofAddrs are the addresses answered for a group of suffixes.
+// Every query rotates the answer order so clients spread across them.
+type spoofAddrs struct {
+	v4   []net.IP
+	v6   []net.IP
+	next atomic.Uint64
+}
+
+// newSpoofAddrs splits ips by address family
+func newSpoofAddrs(ips []net.IP) *spoofAddrs {
+	a := &spoofAddrs{}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			a.v4 = append(a.v4, ip4)
+		} else if ip16 := ip.To16(); ip16 != nil {
+			a.v6 = append(a.v6, ip16)
+		}
+	}
+	return a
+}
+
+// rotate returns ips starting at the next rotation position
+func (a *spoofAddrs) rotate(ips []net.IP) []net.IP {
+	if len(ips) < 2 {
+		return ips
+	}
+	start := int((a.next.Add(1) - 1) % uint64(len(ips))) // Unsigned: no negative index once the counter wraps
+	out := make([]net.IP, 0, len(ips))
+	out = append(out, ips[start:]...)
+	return append(out, ips[:start]...)
+}
@@ -0,0 +1,24 @@
+package dns
+
+import (
+	"math"
+	"net"
+	"testing"
+)
+
+func TestRotateWraps(t *testing.T) {
+	a := newSpoofAddrs(nil)
+	ips := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.3")}
+
+	// Counters above MaxInt64 (or MaxInt32 on 32-bit platforms) must not
+	// turn into negative indexes
+	for _, next := range []uint64{math.MaxInt32, math.MaxInt64, math.MaxUint64} {
+		a.next.Store(next)
+		for i := uint64(0); i < 3; i++ {
+			got := a.rotate(ips)
+			if want := ips[(next+i)%3]; len(got) != 3 || !got[0].Equal(want) {
+				t.Errorf("rotate at %d = %v, want %v first", next+i, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package dns
+
+import (
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// HTTPS/SVCB answers for spoofed names
+const (
+	HTTPSNoData  = "nodata"  // Always NODATA: no QUIC/HTTP3 hints or ECH keys
+	HTTPSRewrite = "rewrite" // Upstream records without ECH and h3, hints replaced by the spoof addresses; NODATA if none are left
+)
+
+// svcbReply answers an HTTPS/SVCB query for a spoofed name with the upstream
+// records rewritten to point at us (see rewriteSVCB), or returns nil to fall
+// back to NODATA
+func (s *Server) svcbReply(r *dns.Msg, rule *rule) *dns.Msg {
+	q := r.Question[0]
+	resp, err := s.resolve(s.upstreamQuery(r))
+	if err != nil || resp.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.AuthenticatedData = false // Our data is never DNSSEC-validated
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype != q.Qtype {
+			continue
+		}
+		if rr = rewriteSVCB(rr, q.Name, rule.addrs, rule.answerTTL()); rr != nil {
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	if len(m.Answer) == 0 {
+		return nil
+	}
+	log.Printf("[DNS] Rewriting %s %s -> %d records (no ECH/h3, spoofed hints)", dns.TypeToString[q.Qtype], q.Name, len(m.Answer))
+	return m
+}
+
+// rewriteSVCB returns a copy of an HTTPS/SVCB record that leads clients to
+// the spoof addresses over TCP: owned by name with target "." (the owner, so
+// clients connect to our addresses), without "ech" and h3 ALPN values, with
+// "ipv4hint"/"ipv6hint" replaced. Returns nil for AliasMode records and
+// records that are unusable without a removed parameter.
+func rewriteSVCB(rr dns.RR, name string, addrs *spoofAddrs, ttl uint32) dns.RR {
+	var svcb *dns.SVCB
+	switch rr := rr.(type) {
+	case *dns.HTTPS:
+		svcb = &rr.SVCB
+	case *dns.SVCB:
+		svcb = rr
+	default:
+		return nil
+	}
+	if svcb.Priority == 0 {
+		// AliasMode would send clients to names we may not spoof
+		return nil
+	}
+
+	out := dns.Copy(rr)
+	var rewritten *dns.SVCB
+	switch out := out.(type) {
+	case *dns.HTTPS:
+		rewritten = &out.SVCB
+	case *dns.SVCB:
+		rewritten = out
+	}
+	rewritten.Hdr.Name = name
+	rewritten.Hdr.Ttl = min(rewritten.Hdr.Ttl, ttl)
+	rewritten.Target = "."
+
+	var removed []dns.SVCBKey
+	var values []dns.SVCBKeyValue
+	for _, kv := range svcb.Value {
+		switch kv := kv.(type) {
+		case *dns.SVCBECHConfig:
+			removed = append(removed, kv.Key())
+			continue
+		case *dns.SVCBAlpn:
+			alpn := slices.DeleteFunc(slices.Clone(kv.Alpn), func(id string) bool {
+				return id == "h3" || strings.HasPrefix(id, "h3-")
+			})
+			if len(alpn) == 0 {
+				removed = append(removed, kv.Key())
+				continue
+			}
+			values = append(values, &dns.SVCBAlpn{Alpn: alpn})
+			continue
+		case *dns.SVCBIPv4Hint:
+			if v4 := addrs.rotate(addrs.v4); len(v4) > 0 {
+				values = append(values, &dns.SVCBIPv4Hint{Hint: slices.Clone(v4)})
+			}
+			continue
+		case *dns.SVCBIPv6Hint:
+			if v6 := addrs.rotate(addrs.v6); len(v6) > 0 {
+				values = append(values, &dns.SVCBIPv6Hint{Hint: slices.Clone(v6)})
+			}
+			continue
+		}
+		values = append(values, kv)
+	}
+
+	// A record whose mandatory parameters were removed must be ignored by
+	// clients (RFC 9460 section 8), and without ALPN values "no-default-alpn"
+	// leaves no protocol to use
+	for _, kv := range values {
+		switch kv := kv.(type) {
+		case *dns.SVCBMandatory:
+			for _, key := range kv.Code {
+				if slices.Contains(removed, key) {
+					return nil
+				}
+			}
+		case *dns.SVCBNoDefaultAlpn:
+			if slices.Contains(removed, dns.SVCB_ALPN) {
+				return nil
+			}
+		}
+	}
+	rewritten.Value = values
+	return out
+}
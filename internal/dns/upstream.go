@@ -0,0 +1,256 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxIdleTLSConns is the number of idle DoT connections kept per upstream
+const maxIdleTLSConns = 4
+
+// upstream is a DNS server that non-spoofed queries are forwarded to
+type upstream interface {
+	// Exchange sends m and returns the upstream's response
+	Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+	// String returns the upstream address for logging
+	String() string
+}
+
+// parseUpstream creates an upstream from its address:
+//   - "8.8.8.8:53" or "8.8.8.8" for plain DNS (UDP, TCP on truncation)
+//   - "tls://dns.google:853" for DNS-over-TLS (port defaults to 853)
+//   - "https://dns.google/dns-query" for DNS-over-HTTPS
+//
+// Hostnames of encrypted upstreams are resolved through dialer so that
+// they never go through our own DNS server.
+func parseUpstream(addr string, timeout time.Duration, dialer *net.Dialer) (upstream, error) {
+	switch {
+	case strings.HasPrefix(addr, "https://"):
+		if _, err := url.Parse(addr); err != nil {
+			return nil, fmt.Errorf("invalid DoH URL: %w", err)
+		}
+		return newHTTPSUpstream(addr, timeout, dialer), nil
+
+	case strings.HasPrefix(addr, "tls://"):
+		hostport := strings.TrimPrefix(addr, "tls://")
+		host, port, err := net.SplitHostPort(hostport)
+		if err != nil {
+			host, port = hostport, "853"
+		}
+		if host == "" {
+			return nil, fmt.Errorf("missing DoT host")
+		}
+		return &tlsUpstream{
+			addr:    net.JoinHostPort(host, port),
+			timeout: timeout,
+			dialer: &tls.Dialer{
+				NetDialer: dialer,
+				Config:    &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12},
+			},
+			idle: make(chan *dns.Conn, maxIdleTLSConns),
+		}, nil
+
+	case strings.Contains(addr, "://"):
+		return nil, fmt.Errorf("unsupported upstream scheme")
+
+	default:
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "53")
+		}
+		return &plainUpstream{
+			addr: addr,
+			udp:  &dns.Client{Timeout: timeout},
+			tcp:  &dns.Client{Net: "tcp", Timeout: timeout},
+		}, nil
+	}
+}
+
+// newBootstrapDialer returns a dialer that resolves hostnames through
+// bootstrapDNS (plain DNS), or the system resolver if it is empty
+func newBootstrapDialer(bootstrapDNS string, timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+	if bootstrapDNS != "" {
+		d.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				bd := net.Dialer{Timeout: timeout}
+				return bd.DialContext(ctx, "udp", bootstrapDNS)
+			},
+		}
+	}
+	return d
+}
+
+// plainUpstream forwards over UDP and retries over TCP when the answer is truncated
+type plainUpstream struct {
+	addr string
+	udp  *dns.Client
+	tcp  *dns.Client
+}
+
+func (u *plainUpstream) String() string { return u.addr }
+
+func (u *plainUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	resp, _, err := u.udp.ExchangeContext(ctx, m, u.addr)
+	if err == nil && resp.Truncated {
+		// Upstream answer did not fit into UDP, retry over TCP so that
+		// TCP clients get the full answer and UDP clients get a
+		// properly truncated one from writeResponse
+		resp, _, err = u.tcp.ExchangeContext(ctx, m, u.addr)
+	}
+	return resp, err
+}
+
+// tlsUpstream forwards over DNS-over-TLS (RFC 7858), reusing idle connections
+type tlsUpstream struct {
+	addr    string
+	timeout time.Duration
+	dialer  *tls.Dialer
+	idle    chan *dns.Conn
+}
+
+func (u *tlsUpstream) String() string { return "tls://" + u.addr }
+
+func (u *tlsUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	// A pooled connection may have been closed by the server while idle,
+	// so a failure on a reused connection is retried once on a fresh one
+	for {
+		conn, reused, err := u.conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := u.exchangeConn(ctx, conn, m)
+		if err != nil {
+			conn.Close()
+			if reused {
+				continue
+			}
+			return nil, err
+		}
+
+		u.release(conn)
+		return resp, nil
+	}
+}
+
+// conn returns an idle connection or dials a new one
+func (u *tlsUpstream) conn(ctx context.Context) (*dns.Conn, bool, error) {
+	select {
+	case conn := <-u.idle:
+		return conn, true, nil
+	default:
+	}
+
+	c, err := u.dialer.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, false, err
+	}
+	return &dns.Conn{Conn: c}, false, nil
+}
+
+// release returns a connection to the idle pool, closing it if the pool is full
+func (u *tlsUpstream) release(conn *dns.Conn) {
+	select {
+	case u.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// exchangeConn sends m on conn and waits for the response with the same ID
+func (u *tlsUpstream) exchangeConn(ctx context.Context, conn *dns.Conn, m *dns.Msg) (*dns.Msg, error) {
+	deadline := time.Now().Add(u.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	if err := conn.WriteMsg(m); err != nil {
+		return nil, err
+	}
+	for {
+		resp, err := conn.ReadMsg()
+		if err != nil {
+			return nil, err
+		}
+		if resp.Id == m.Id {
+			return resp, nil
+		}
+	}
+}
+
+// httpsUpstream forwards over DNS-over-HTTPS (RFC 8484) using a keep-alive HTTP client
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPSUpstream(url string, timeout time.Duration, dialer *net.Dialer) *httpsUpstream {
+	return &httpsUpstream{
+		url: url,
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: maxIdleTLSConns,
+				IdleConnTimeout:     90 * time.Second,
+				TLSHandshakeTimeout: timeout,
+				TLSClientConfig:     &tls.Config{MinVersion: tls.VersionTLS12},
+			},
+		},
+	}
+}
+
+func (u *httpsUpstream) String() string { return u.url }
+
+func (u *httpsUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	// Use ID 0 for HTTP cache friendliness (RFC 8484 section 4.1)
+	q := m.Copy()
+	q.Id = 0
+	packed, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+
+	httpResp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH status %s", httpResp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, err
+	}
+	resp.Id = m.Id
+	return resp, nil
+}
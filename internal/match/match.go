@@ -0,0 +1,326 @@
+// Package match implements the domain name rules shared by the DNS server and
+// the proxy, so spoofing and proxying always agree on which names are ours.
+//
+// Pattern syntax:
+//
+//	example.com, .example.com  the name and all its subdomains (suffix)
+//	=example.com               only the name itself (exact)
+//	*.example.com              only subdomains of the name
+//	api-*.example.com          glob with *, ? and [...] (see path.Match)
+//	/^api[0-9]+\.example\.com$/ regular expression on the lowercase name
+//	!pattern                   exception: matching names never match
+//
+// Names are compared case-insensitively and without the trailing dot. Names of
+// suffix, exact and subdomain patterns must be valid domain names; in
+// comma-separated lists (see SplitList) a /regexp/ may contain commas.
+package match
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Kind is the type of a pattern
+type Kind int
+
+const (
+	Suffix     Kind = iota // The name and all its subdomains
+	Exact                  // Only the name itself
+	Subdomains             // Only names below the name
+	Glob                   // Shell-style glob on the whole name
+	Regexp                 // Regular expression on the whole name
+)
+
+// Pattern is a parsed rule pattern
+type Pattern struct {
+	Kind   Kind
+	Name   string // Lowercase name without leading/trailing dots (Suffix, Exact, Subdomains) or the glob
+	Except bool   // Exception: names matching it are excluded
+	re     *regexp.Regexp
+}
+
+// Parse parses a pattern (see the package documentation)
+func Parse(s string) (Pattern, error) {
+	var p Pattern
+	s = strings.TrimSpace(s)
+	if rest, ok := strings.CutPrefix(s, "!"); ok {
+		p.Except = true
+		s = rest
+	}
+
+	if strings.HasPrefix(s, "/") {
+		if !isRegexp(s) {
+			return Pattern{}, fmt.Errorf("unterminated regexp %q", s)
+		}
+		re, err := regexp.Compile(s[1 : len(s)-1])
+		if err != nil {
+			return Pattern{}, fmt.Errorf("invalid regexp %s: %w", s, err)
+		}
+		p.Kind, p.Name, p.re = Regexp, s, re
+		return p, nil
+	}
+
+	s = strings.ToLower(s)
+	switch {
+	case strings.HasPrefix(s, "="):
+		p.Kind, p.Name = Exact, normalize(s[1:])
+	case strings.HasPrefix(s, "*.") && !strings.ContainsAny(s[2:], "*?["):
+		p.Kind, p.Name = Subdomains, normalize(s[2:])
+	case strings.ContainsAny(s, "*?["):
+		if _, err := path.Match(s, ""); err != nil {
+			return Pattern{}, fmt.Errorf("invalid glob %q: %w", s, err)
+		}
+		p.Kind, p.Name = Glob, strings.TrimSuffix(s, ".")
+	default:
+		p.Kind, p.Name = Suffix, normalize(s)
+	}
+	if p.Name == "" {
+		return Pattern{}, fmt.Errorf("empty pattern %q", s)
+	}
+	if p.Kind != Glob && !validName(p.Name) {
+		return Pattern{}, fmt.Errorf("invalid domain name in pattern %q", s)
+	}
+	return p, nil
+}
+
+// SplitList splits a comma-separated list of patterns into trimmed, non-empty
+// fields. Commas inside a /regexp/ do not split it.
+func SplitList(s string) []string {
+	var fields []string
+	var field string
+	open := false // field is an unterminated regexp
+	for _, part := range strings.Split(s, ",") {
+		if open {
+			field += "," + part
+		} else {
+			field = part
+		}
+		f := strings.TrimPrefix(strings.TrimSpace(field), "!")
+		if open = strings.HasPrefix(f, "/") && !isRegexp(f); open {
+			continue
+		}
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	if field = strings.TrimSpace(field); open && field != "" {
+		fields = append(fields, field) // Rejected by Parse
+	}
+	return fields
+}
+
+// isRegexp reports whether s is a /regexp/ pattern
+func isRegexp(s string) bool {
+	return len(s) >= 2 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/")
+}
+
+// validName reports whether name is a domain name without characters that
+// only make sense in other pattern kinds or lists
+func validName(name string) bool {
+	if strings.ContainsAny(name, " \t/\\,=!") {
+		return false
+	}
+	_, ok := dns.IsDomainName(name)
+	return ok
+}
+
+// Zone returns the name a Suffix, Exact or Subdomains pattern is anchored at,
+// or "" for globs and regular expressions
+func (p Pattern) Zone() string {
+	switch p.Kind {
+	case Suffix, Exact, Subdomains:
+		return p.Name
+	}
+	return ""
+}
+
+// normalize lowercases a name and strips leading and trailing dots
+func normalize(name string) string {
+	return strings.Trim(strings.ToLower(name), ".")
+}
+
+// Matcher maps patterns to values. A name matches if a pattern matches it and
+// no exception does. The most specific pattern wins: an exact name, then the
+// longest suffix or subdomain pattern, then globs and regular expressions in
+// the order they were added. Adding a pattern that is already present keeps
+// the first value.
+type Matcher[V any] struct {
+	rules  set
+	except set
+	values []V
+}
+
+// New returns an empty matcher
+func New[V any]() *Matcher[V] {
+	return &Matcher[V]{}
+}
+
+// Add parses pattern and adds it with value v. Values of exceptions are ignored.
+func (m *Matcher[V]) Add(pattern string, v V) error {
+	p, err := Parse(pattern)
+	if err != nil {
+		return err
+	}
+	m.AddPattern(p, v)
+	return nil
+}
+
+// AddPattern adds a parsed pattern with value v
+func (m *Matcher[V]) AddPattern(p Pattern, v V) {
+	if p.Except {
+		m.except.add(p, 0)
+		return
+	}
+	if m.rules.add(p, len(m.values)) {
+		m.values = append(m.values, v)
+	}
+}
+
+// Match returns the value of the most specific pattern matching name
+func (m *Matcher[V]) Match(name string) (V, bool) {
+	var zero V
+	if m == nil {
+		return zero, false
+	}
+	name = normalize(name)
+	i, ok := m.rules.lookup(name)
+	if !ok {
+		return zero, false
+	}
+	if _, excluded := m.except.lookup(name); excluded {
+		return zero, false
+	}
+	return m.values[i], true
+}
+
+// Len returns the number of patterns, including exceptions
+func (m *Matcher[V]) Len() int {
+	if m == nil {
+		return 0
+	}
+	return m.rules.len + m.except.len
+}
+
+// set is a collection of patterns, each referring to a value index
+type set struct {
+	root  node
+	globs []globRule
+	len   int
+}
+
+// node is a label trie node. Names are stored reversed, so "api.example.com"
+// is root -> com -> example -> api; indices are value index + 1, 0 if unset.
+type node struct {
+	children   map[string]*node
+	exact      int // Exact pattern for this name
+	suffix     int // Suffix pattern for this name
+	subdomains int // Subdomains pattern for this name
+}
+
+// globRule is a glob or regular expression pattern
+type globRule struct {
+	glob  string
+	re    *regexp.Regexp
+	index int
+}
+
+// add adds p with value index i, returning false if p was already present
+func (s *set) add(p Pattern, i int) bool {
+	switch p.Kind {
+	case Glob, Regexp:
+		for _, g := range s.globs {
+			if g.glob == p.Name {
+				return false
+			}
+		}
+		s.globs = append(s.globs, globRule{glob: p.Name, re: p.re, index: i})
+		s.len++
+		return true
+	}
+
+	n := &s.root
+	for _, label := range reverseLabels(p.Name) {
+		child := n.children[label]
+		if child == nil {
+			if n.children == nil {
+				n.children = make(map[string]*node)
+			}
+			child = new(node)
+			n.children[label] = child
+		}
+		n = child
+	}
+
+	slot := &n.suffix
+	switch p.Kind {
+	case Exact:
+		slot = &n.exact
+	case Subdomains:
+		slot = &n.subdomains
+	}
+	if *slot != 0 {
+		return false
+	}
+	*slot = i + 1
+	s.len++
+	return true
+}
+
+// lookup returns the value index of the most specific pattern matching the
+// normalized name
+func (s *set) lookup(name string) (int, bool) {
+	best := 0
+	labels := reverseLabels(name)
+	n := &s.root
+	for depth, label := range labels {
+		// Patterns at this node cover name if it lies strictly below
+		if n.suffix != 0 {
+			best = n.suffix
+		}
+		if n.subdomains != 0 {
+			best = n.subdomains
+		}
+		if n = n.children[label]; n == nil {
+			break
+		}
+		if depth == len(labels)-1 {
+			switch {
+			case n.exact != 0:
+				best = n.exact
+			case n.suffix != 0:
+				best = n.suffix
+			}
+		}
+	}
+	if best != 0 {
+		return best - 1, true
+	}
+
+	for _, g := range s.globs {
+		if g.re != nil && g.re.MatchString(name) {
+			return g.index, true
+		}
+		if g.re == nil {
+			if ok, _ := path.Match(g.glob, name); ok {
+				return g.index, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// reverseLabels splits a normalized name into labels, top-level domain first
+func reverseLabels(name string) []string {
+	if name == "" {
+		return nil
+	}
+	labels := strings.Split(name, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return labels
+}
@@ -0,0 +1,177 @@
+package match
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatcher(t *testing.T) {
+	m := New[string]()
+	for _, r := range []struct{ pattern, value string }{
+		{".example.com", "suffix"},
+		{"=exact.example.com", "exact"},
+		{"*.sub.example.com", "subdomains"},
+		{"deep.example.com", "deep"},
+		{".both.test", "both-suffix"},
+		{"*.both.test", "both-subdomains"},
+		{".bing.com", "bing"},
+		{"!www.bing.com", ""},
+		{"!=only.bing.com", ""},
+		{"api-*.glob.test", "glob"},
+		{"?.glob.test", "glob-char"},
+		{"api-*.example.com", "glob-shadowed"},
+		{`/^r[0-9]+\.re\.test$/`, "regexp"},
+		{"Example.ORG.", "org"},
+		{".dup.test", "first"},
+		{"dup.test.", "second"},
+	} {
+		if err := m.Add(r.pattern, r.value); err != nil {
+			t.Fatalf("Add(%q): %v", r.pattern, err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		want string // "" for no match
+	}{
+		// Suffix: the name and everything below, label-aligned
+		{"example.com", "suffix"},
+		{"api.example.com", "suffix"},
+		{"a.b.example.com", "suffix"},
+		{"notexample.com", ""},
+		{"com", ""},
+
+		// Exact beats the suffix for the name only
+		{"exact.example.com", "exact"},
+		{"x.exact.example.com", "suffix"},
+
+		// Subdomains: below the name, not the name itself
+		{"sub.example.com", "suffix"},
+		{"a.sub.example.com", "subdomains"},
+		{"a.b.sub.example.com", "subdomains"},
+
+		// The longest suffix wins
+		{"deep.example.com", "deep"},
+		{"x.deep.example.com", "deep"},
+
+		// Suffix and subdomains on the same name
+		{"both.test", "both-suffix"},
+		{"x.both.test", "both-subdomains"},
+
+		// Exceptions: suffix exceptions cover subdomains, exact ones do not
+		{"bing.com", "bing"},
+		{"api.bing.com", "bing"},
+		{"www.bing.com", ""},
+		{"cdn.www.bing.com", ""},
+		{"only.bing.com", ""},
+		{"x.only.bing.com", "bing"},
+
+		// Globs and regexps, after all trie patterns
+		{"api-1.glob.test", "glob"},
+		{"web.glob.test", ""},
+		{"a.glob.test", "glob-char"},
+		{"ab.glob.test", ""},
+		{"api-1.example.com", "suffix"},
+		{"r12.re.test", "regexp"},
+		{"rx.re.test", ""},
+		{"xr1.re.test", ""},
+
+		// Case and trailing dots are normalized
+		{"API.Example.COM.", "suffix"},
+		{"EXACT.example.com.", "exact"},
+		{"API-2.GLOB.TEST.", "glob"},
+		{"R7.RE.TEST.", "regexp"},
+		{"www.example.org", "org"},
+
+		// A duplicate pattern keeps the first value
+		{"x.dup.test", "first"},
+	}
+	for _, tt := range tests {
+		got, ok := m.Match(tt.name)
+		if ok != (tt.want != "") || got != tt.want {
+			t.Errorf("Match(%q) = %q, %v; want %q", tt.name, got, ok, tt.want)
+		}
+	}
+
+	if got, want := m.Len(), 15; got != want {
+		t.Errorf("Len() = %d, want %d", got, want)
+	}
+}
+
+func TestNilMatcher(t *testing.T) {
+	var m *Matcher[int]
+	if _, ok := m.Match("example.com"); ok {
+		t.Error("nil matcher matched")
+	}
+	if m.Len() != 0 {
+		t.Errorf("nil matcher Len() = %d", m.Len())
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		pattern string
+		kind    Kind
+		name    string
+		except  bool
+		zone    string
+	}{
+		{"example.com", Suffix, "example.com", false, "example.com"},
+		{".Example.com.", Suffix, "example.com", false, "example.com"},
+		{"=example.com", Exact, "example.com", false, "example.com"},
+		{"*.example.com", Subdomains, "example.com", false, "example.com"},
+		{"*example.com", Glob, "*example.com", false, ""},
+		{"*.api-*.example.com", Glob, "*.api-*.example.com", false, ""},
+		{"api[0-9].example.com.", Glob, "api[0-9].example.com", false, ""},
+		{`/^a\.example\.com$/`, Regexp, `/^a\.example\.com$/`, false, ""},
+		{"!www.example.com", Suffix, "www.example.com", true, "www.example.com"},
+		{" !=www.example.com ", Exact, "www.example.com", true, "www.example.com"},
+	}
+	for _, tt := range tests {
+		p, err := Parse(tt.pattern)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.pattern, err)
+			continue
+		}
+		if p.Kind != tt.kind || p.Name != tt.name || p.Except != tt.except || p.Zone() != tt.zone {
+			t.Errorf("Parse(%q) = {%v %q %v zone %q}, want {%v %q %v zone %q}",
+				tt.pattern, p.Kind, p.Name, p.Except, p.Zone(), tt.kind, tt.name, tt.except, tt.zone)
+		}
+	}
+
+	for _, pattern := range []string{
+		"", ".", "=", "!", "*.", "/[/", "api[.example.com",
+		// Unterminated regexps, e.g. /^a{1,3}\.x$/ split at its comma
+		"/", "/^a{1", "!/^a{1", "3}\\.x$/",
+		// Names that are not domain names
+		"a b.example.com", "=a/b.example.com", "*.a\\b.example.com", "a..example.com", "==example.com",
+		strings.Repeat("a", 64) + ".example.com",
+	} {
+		if _, err := Parse(pattern); err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", pattern)
+		}
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	tests := []struct {
+		list string
+		want []string
+	}{
+		{"", nil},
+		{" , ,", nil},
+		{".a.com, =b.com ,*.c.com", []string{".a.com", "=b.com", "*.c.com"}},
+		{`/^a{1,3}\.x$/,b.com`, []string{`/^a{1,3}\.x$/`, "b.com"}},
+		{`a.com, !/^(b|c){2,}\.x$/ ,/,/`, []string{"a.com", `!/^(b|c){2,}\.x$/`, "/,/"}},
+		// An unterminated regexp takes the rest of the list and fails to parse
+		{`a.com,/^a{1,3}\.x$,b.com`, []string{"a.com", `/^a{1,3}\.x$,b.com`}},
+	}
+	for _, tt := range tests {
+		if got := SplitList(tt.list); strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+			t.Errorf("SplitList(%q) = %q, want %q", tt.list, got, tt.want)
+		}
+	}
+	if _, err := Parse(SplitList(`/^a{1,3}\.x$,b.com`)[0]); err == nil {
+		t.Error("Parse accepted an unterminated regexp")
+	}
+}
@@ -9,21 +9,26 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"DnsSpoofer/internal/match"
 )
 
 // Config holds proxy server configuration
 type Config struct {
-	HTTPAddr        string        // Address for HTTP proxy (e.g., ":80")
-	HTTPSAddr       string        // Address for HTTPS proxy (e.g., ":443")
-	AllowedSuffixes []string      // Domain suffixes allowed for proxying
-	ResolverDNS     string        // DNS server for resolving backend hosts (e.g., "8.8.8.8:53")
-	DialTimeout     time.Duration // Timeout for connecting to backend
-	PeekTimeout     time.Duration // Timeout for reading initial bytes (SNI/Host)
+	HTTPAddr        string                           // Address for HTTP proxy (e.g., ":80")
+	HTTPSAddr       string                           // Address for HTTPS proxy (e.g., ":443")
+	AllowedSuffixes []string                         // Name patterns allowed for proxying (same syntax as the DNS spoof patterns, see package match)
+	Allowed         func(host string) (string, bool) // Decides which hosts are proxied instead of AllowedSuffixes and which name is resolved for the backend (e.g., dns.Server.ProxyTarget)
+	AllowedNetworks []*net.IPNet                     // Hosts not allowed by name are proxied if they resolve into these networks
+	ResolverDNS     string                           // DNS server for resolving backend hosts (e.g., "8.8.8.8:53")
+	DialTimeout     time.Duration                    // Timeout for connecting to backend
+	PeekTimeout     time.Duration                    // Timeout for reading initial bytes (SNI/Host)
 }
 
 // Server is a TCP proxy that routes based on SNI/Host header
 type Server struct {
 	config        Config
+	allowed       *match.Matcher[struct{}]
 	httpListener  net.Listener
 	httpsListener net.Listener
 	resolver      *net.Resolver
@@ -33,12 +38,15 @@ type Server struct {
 
 // New creates a new proxy server
 func New(cfg Config) *Server {
-	// Normalize suffixes
-	suffixes := make([]string, len(cfg.AllowedSuffixes))
-	for i, s := range cfg.AllowedSuffixes {
-		suffixes[i] = strings.ToLower(s)
+	allowed := match.New[struct{}]()
+	for _, pattern := range cfg.AllowedSuffixes {
+		if strings.TrimSpace(pattern) == "" {
+			continue
+		}
+		if err := allowed.Add(pattern, struct{}{}); err != nil {
+			log.Printf("[Proxy] Ignoring allowed pattern: %v", err)
+		}
 	}
-	cfg.AllowedSuffixes = suffixes
 
 	if cfg.DialTimeout == 0 {
 		cfg.DialTimeout = 5 * time.Second
@@ -49,18 +57,27 @@ func New(cfg Config) *Server {
 
 	return &Server{
 		config:     cfg,
+		allowed:    allowed,
 		resolver:   NewResolver(cfg.ResolverDNS, cfg.DialTimeout),
 		shutdownCh: make(chan struct{}),
 	}
 }
 
-// isAllowed checks if the host is in the allowed suffixes list
-func (s *Server) isAllowed(host string) bool {
-	host = strings.ToLower(host)
+// isAllowed checks if the host may be proxied and returns the name to
+// resolve for its backend
+func (s *Server) isAllowed(host string) (string, bool) {
+	if s.config.Allowed != nil {
+		return s.config.Allowed(host)
+	}
+	_, ok := s.allowed.Match(host)
+	return host, ok
+}
 
-	for _, suffix := range s.config.AllowedSuffixes {
-		cleanSuffix := strings.TrimPrefix(suffix, ".")
-		if host == cleanSuffix || strings.HasSuffix(host, "."+cleanSuffix) {
+// inAllowedNetwork reports whether ip is inside one of the allowed networks
+func (s *Server) inAllowedNetwork(ip string) bool {
+	addr := net.ParseIP(ip)
+	for _, n := range s.config.AllowedNetworks {
+		if addr != nil && n.Contains(addr) {
 			return true
 		}
 	}
@@ -174,19 +191,31 @@ func (s *Server) handleConnection(clientConn net.Conn, isTLS bool) {
 		return
 	}
 
-	// Check if host is allowed
-	if !s.isAllowed(host) {
-		log.Printf("[Proxy] Host not allowed: %s", host)
-		return
+	// Check if host is allowed; hosts not allowed by name may still be
+	// allowed by the network they resolve into
+	backendHost, allowed := s.isAllowed(host)
+	if !allowed {
+		if len(s.config.AllowedNetworks) == 0 {
+			log.Printf("[Proxy] Host not allowed: %s", host)
+			return
+		}
+		backendHost = host
+	}
+	if backendHost != host {
+		log.Printf("[Proxy] %s is an alias of %s", host, backendHost)
 	}
 
-	// Resolve host to IP using our custom resolver (to avoid loops)
+	// Resolve the backend to IP using our custom resolver (to avoid loops)
 	ctx, cancel := context.WithTimeout(context.Background(), s.config.DialTimeout)
 	defer cancel()
 
-	ip, err := ResolveHost(ctx, s.resolver, host)
+	ip, err := ResolveHost(ctx, s.resolver, backendHost)
 	if err != nil {
-		log.Printf("[Proxy] Resolve error for %s: %v", host, err)
+		log.Printf("[Proxy] Resolve error for %s: %v", backendHost, err)
+		return
+	}
+	if !allowed && !s.inAllowedNetwork(ip) {
+		log.Printf("[Proxy] Host not allowed: %s (%s)", host, ip)
 		return
 	}
 
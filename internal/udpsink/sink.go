@@ -10,6 +10,15 @@ import (
 
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	minIPv6MTU = 1280 // Minimum link MTU of IPv6 (RFC 8200)
+	// Data of the invoking packet an ICMPv6 error can quote without exceeding
+	// the minimum IPv6 MTU (RFC 4443 2.4(c)): the error's IPv6 and ICMPv6
+	// headers and the quoted IPv6 and UDP headers come first
+	maxICMPv6Quote = minIPv6MTU - 40 - 8 - 40 - 8
 )
 
 // Config holds UDP sink configuration
@@ -24,6 +33,7 @@ type Sink struct {
 	config     Config
 	conn       *net.UDPConn
 	icmpConn   *icmp.PacketConn // For sending ICMP Port Unreachable
+	icmp6Conn  *icmp.PacketConn // For sending ICMPv6 Port Unreachable
 	shutdownCh chan struct{}
 	wg         sync.WaitGroup
 	dropped    atomic.Uint64 // Counter for dropped packets
@@ -38,28 +48,29 @@ func New(cfg Config) *Sink {
 	}
 }
 
-// Start starts the UDP sink listener (IPv4 only)
+// Start starts the UDP sink listener.
+// An empty or "::" host listens dual-stack (IPv4 and IPv6), "0.0.0.0" IPv4 only.
 func (s *Sink) Start() error {
-	// Bind IPv4 only so we don't listen on IPv6
 	host, port, err := net.SplitHostPort(s.config.ListenAddr)
 	if err != nil || port == "" {
 		port = "443"
 		host = ""
 	}
-	if host == "" || host == "::" {
-		host = "0.0.0.0"
+	network := "udp"
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		network = "udp4"
 	}
-	addr, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(host, port))
+	addr, err := net.ResolveUDPAddr(network, net.JoinHostPort(host, port))
 	if err != nil {
 		return fmt.Errorf("resolve UDP address: %w", err)
 	}
 
-	s.conn, err = net.ListenUDP("udp4", addr)
+	s.conn, err = net.ListenUDP(network, addr)
 	if err != nil {
 		return fmt.Errorf("listen UDP: %w", err)
 	}
 
-	// Try to create ICMP connection for sending Port Unreachable (requires CAP_NET_RAW or root)
+	// Try to create ICMP connections for sending Port Unreachable (requires CAP_NET_RAW or root)
 	// If this fails, we'll just drop packets silently (slower fallback but still works)
 	s.icmpConn, err = icmp.ListenPacket("ip4:icmp", "0.0.0.0")
 	if err != nil {
@@ -68,6 +79,13 @@ func (s *Sink) Start() error {
 	} else {
 		log.Printf("[UDPSink] ICMP Port Unreachable enabled (fast TCP fallback)")
 	}
+	if network == "udp" {
+		s.icmp6Conn, err = icmp.ListenPacket("ip6:ipv6-icmp", "::")
+		if err != nil {
+			log.Printf("[UDPSink] Warning: Cannot create ICMPv6 socket: %v. IPv6 packets will be dropped silently", err)
+			s.icmp6Conn = nil
+		}
+	}
 
 	s.wg.Add(1)
 	go func() {
@@ -111,7 +129,7 @@ func (s *Sink) readLoop() {
 
 		// Send ICMP Port Unreachable if ICMP socket is available (faster TCP fallback)
 		// Otherwise just drop silently (slower fallback but still works)
-		if s.icmpConn != nil {
+		if s.icmpConn != nil || s.icmp6Conn != nil {
 			if err := s.sendICMPPortUnreachable(remoteAddr, buf[:n]); err != nil {
 				// Log error but continue - ICMP is best-effort
 				if s.icmpSent.Load() < 5 {
@@ -125,7 +143,7 @@ func (s *Sink) readLoop() {
 		count := s.dropped.Add(1)
 		if count%1000 == 0 || count <= 10 {
 			// Log first 10 packets and then every 1000th to avoid log spam
-			if s.icmpConn != nil {
+			if s.icmpConn != nil || s.icmp6Conn != nil {
 				log.Printf("[UDPSink] Dropped packet #%d from %s (%d bytes), ICMP sent: %d", count, remoteAddr, n, s.icmpSent.Load())
 			} else {
 				log.Printf("[UDPSink] Dropped packet #%d from %s (%d bytes)", count, remoteAddr, n)
@@ -137,6 +155,9 @@ func (s *Sink) readLoop() {
 // sendICMPPortUnreachable sends an ICMP Port Unreachable message to the source.
 // This helps clients detect that the port is closed immediately, speeding up TCP fallback.
 func (s *Sink) sendICMPPortUnreachable(remoteAddr *net.UDPAddr, originalPacket []byte) error {
+	if remoteAddr.IP.To4() == nil {
+		return s.sendICMPv6PortUnreachable(remoteAddr, originalPacket)
+	}
 	if s.icmpConn == nil {
 		return fmt.Errorf("ICMP socket not available")
 	}
@@ -145,7 +166,8 @@ func (s *Sink) sendICMPPortUnreachable(remoteAddr *net.UDPAddr, originalPacket [
 	localAddr := s.conn.LocalAddr().(*net.UDPAddr)
 	localIP := localAddr.IP.To4()
 	if localIP == nil {
-		return fmt.Errorf("local IP is not IPv4")
+		// Dual-stack socket bound to "::", the address is unknown
+		localIP = net.IPv4zero.To4()
 	}
 
 	// Construct IP header (20 bytes) + UDP header (8 bytes) for ICMP error payload
@@ -198,6 +220,68 @@ func (s *Sink) sendICMPPortUnreachable(remoteAddr *net.UDPAddr, originalPacket [
 	return err
 }
 
+// sendICMPv6PortUnreachable sends an ICMPv6 Destination Unreachable (port unreachable)
+// message to an IPv6 source. The kernel fills in the ICMPv6 checksum.
+func (s *Sink) sendICMPv6PortUnreachable(remoteAddr *net.UDPAddr, originalPacket []byte) error {
+	if s.icmp6Conn == nil {
+		return fmt.Errorf("ICMPv6 socket not available")
+	}
+
+	msgBytes, err := icmpv6PortUnreachable(remoteAddr, s.conn.LocalAddr().(*net.UDPAddr), originalPacket)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.icmp6Conn.WriteTo(msgBytes, &net.IPAddr{IP: remoteAddr.IP, Zone: remoteAddr.Zone})
+	return err
+}
+
+// icmpv6PortUnreachable builds the ICMPv6 port unreachable message for a
+// packet from remoteAddr to localAddr, without the checksum
+func icmpv6PortUnreachable(remoteAddr, localAddr *net.UDPAddr, originalPacket []byte) ([]byte, error) {
+	localIP := localAddr.IP.To16()
+	if localIP == nil {
+		localIP = net.IPv6unspecified
+	}
+
+	// Invoking packet as it was received: IPv6 header (40 bytes) + UDP header (8 bytes) + data,
+	// truncated so the ICMPv6 message stays within the minimum IPv6 MTU (RFC 4443)
+	udpLen := 8 + len(originalPacket)
+	ipHeader := make([]byte, 40)
+	ipHeader[0] = 0x60 // Version 6
+	ipHeader[4] = byte(udpLen >> 8)
+	ipHeader[5] = byte(udpLen)
+	ipHeader[6] = 17 // Next header: UDP
+	ipHeader[7] = 64 // Hop limit
+	copy(ipHeader[8:24], remoteAddr.IP.To16())
+	copy(ipHeader[24:40], localIP)
+
+	udpHeader := make([]byte, 8)
+	udpHeader[0] = byte(remoteAddr.Port >> 8)
+	udpHeader[1] = byte(remoteAddr.Port)
+	udpHeader[2] = byte(localAddr.Port >> 8)
+	udpHeader[3] = byte(localAddr.Port)
+	udpHeader[4] = byte(udpLen >> 8)
+	udpHeader[5] = byte(udpLen)
+
+	payload := append(ipHeader, udpHeader...)
+	payload = append(payload, originalPacket[:min(maxICMPv6Quote, len(originalPacket))]...)
+
+	msg := &icmp.Message{
+		Type: ipv6.ICMPTypeDestinationUnreachable,
+		Code: 4, // Port Unreachable
+		Body: &icmp.DstUnreach{
+			Data: payload,
+		},
+	}
+
+	msgBytes, err := msg.Marshal(nil)
+	if err != nil {
+		return nil, fmt.Errorf("marshal ICMPv6: %w", err)
+	}
+	return msgBytes, nil
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -225,6 +309,9 @@ func (s *Sink) Shutdown(ctx context.Context) error {
 	if s.icmpConn != nil {
 		s.icmpConn.Close()
 	}
+	if s.icmp6Conn != nil {
+		s.icmp6Conn.Close()
+	}
 
 	done := make(chan struct{})
 	go func() {
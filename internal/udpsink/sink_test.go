@@ -0,0 +1,43 @@
+package udpsink
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
+)
+
+func TestICMPv6PortUnreachableSize(t *testing.T) {
+	remote := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 50000}
+	local := &net.UDPAddr{IP: net.ParseIP("2001:db8::443"), Port: 443}
+
+	for _, size := range []int{0, 100, maxICMPv6Quote, maxICMPv6Quote + 1, 1350, 65000} {
+		packet := bytes.Repeat([]byte{0xab}, size)
+		msg, err := icmpv6PortUnreachable(remote, local, packet)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+
+		// The error datagram is an IPv6 header and the ICMPv6 message
+		if got := 40 + len(msg); got > minIPv6MTU {
+			t.Errorf("%d bytes: ICMPv6 error datagram of %d bytes exceeds %d", size, got, minIPv6MTU)
+		}
+
+		m, err := icmp.ParseMessage(58, msg)
+		if err != nil {
+			t.Fatalf("%d bytes: parsing message: %v", size, err)
+		}
+		if m.Type != ipv6.ICMPTypeDestinationUnreachable || m.Code != 4 {
+			t.Errorf("%d bytes: type %v code %d, want port unreachable", size, m.Type, m.Code)
+		}
+		data := m.Body.(*icmp.DstUnreach).Data
+		if want := 48 + min(size, maxICMPv6Quote); len(data) != want {
+			t.Errorf("%d bytes: quoted %d bytes, want %d", size, len(data), want)
+		}
+		if !net.IP(data[8:24]).Equal(remote.IP) || !net.IP(data[24:40]).Equal(local.IP) {
+			t.Errorf("%d bytes: quoted addresses %v -> %v", size, net.IP(data[8:24]), net.IP(data[24:40]))
+		}
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"DnsSpoofer/internal/dns"
+	"DnsSpoofer/internal/match"
 	"DnsSpoofer/internal/proxy"
 	"DnsSpoofer/internal/udpsink"
 )
@@ -54,6 +55,30 @@ var (
 	defaultUpstreamDNS = []string{"8.8.8.8:53", "1.1.1.1:53"}
 )
 
+// stringList is a flag that can be repeated
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, " ") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
+// parseFamily parses a comma-separated list of spoof IPs that must all be
+// IPv4 (or IPv6) addresses
+func parseFamily(list string, v4 bool) []net.IP {
+	if list == "" {
+		return nil
+	}
+	ips, err := dns.ParseIPs(list)
+	if err != nil || len(ips) == 0 {
+		log.Fatalf("Invalid spoof IP list: %s", list)
+	}
+	for _, ip := range ips {
+		if (ip.To4() != nil) != v4 {
+			log.Fatalf("Spoof IP %s has the wrong address family", ip)
+		}
+	}
+	return ips
+}
+
 func main() {
 	// Parse command line flags
 	// Default spoof IP from environment variable, or use default server IP
@@ -61,27 +86,180 @@ func main() {
 	if defaultSpoofIP == "" {
 		defaultSpoofIP = "95.164.123.192" // Default server IP (can be overridden via DNS_SPOOFER_IP env var or -spoof-ip flag)
 	}
-	spoofIP := flag.String("spoof-ip", defaultSpoofIP, "IP address to return for spoofed domains (default: 95.164.123.192, or set DNS_SPOOFER_IP env var)")
-	dnsPort := flag.String("dns-port", ":53", "DNS server listen address")
+	spoofIPv4 := flag.String("spoof-ipv4", "", "Comma-separated IPv4 addresses for spoofed A answers, replacing IPv4 addresses from -spoof-ip")
+	spoofIPv6 := flag.String("spoof-ipv6", os.Getenv("DNS_SPOOFER_IPV6"), "Comma-separated IPv6 addresses for spoofed AAAA answers, replacing IPv6 addresses from -spoof-ip (or set DNS_SPOOFER_IPV6 env var)")
+	spoofIP := flag.String("spoof-ip", defaultSpoofIP, "Comma-separated IP addresses to return for spoofed domains, answers are rotated (default: 95.164.123.192, or set DNS_SPOOFER_IP env var)")
+	dnsPort := flag.String("dns-port", ":53", "DNS server listen address (UDP and TCP)")
+	dotPort := flag.String("dot-port", "", "DNS-over-TLS listen address (e.g., :853), disabled if empty")
+	dohPort := flag.String("doh-port", "", "DNS-over-HTTPS listen address serving /dns-query (e.g., :8443), disabled if empty")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file for DNS-over-TLS/HTTPS (reloaded on change)")
+	tlsKey := flag.String("tls-key", "", "TLS private key file for DNS-over-TLS/HTTPS (reloaded on change)")
+	dnsTCPIdle := flag.Duration("dns-tcp-idle-timeout", 10*time.Second, "Idle timeout for DNS over TCP connections")
 	httpPort := flag.String("http-port", ":80", "HTTP proxy listen address")
 	httpsPort := flag.String("https-port", ":443", "HTTPS proxy listen address")
 	udpSinkPort := flag.String("udp-sink-port", ":443", "UDP sink listen address (drops QUIC/HTTP3 traffic to force TCP fallback)")
-	spoofSuffixes := flag.String("spoof-suffixes", strings.Join(defaultSpoofSuffixes, ","), "Comma-separated list of domain suffixes to spoof")
-	upstreamDNS := flag.String("upstream-dns", strings.Join(defaultUpstreamDNS, ","), "Comma-separated list of upstream DNS servers")
-	resolverDNS := flag.String("resolver-dns", "8.8.8.8:53", "DNS server for proxy to resolve backend hosts (to avoid loops)")
+	spoofSuffixes := flag.String("spoof-suffixes", strings.Join(defaultSpoofSuffixes, ","), "Comma-separated name patterns to spoof: suffix (.example.com), exact (=example.com), subdomains (*.example.com), glob, /regexp/, !exception")
+	var spoofTargetFlags stringList
+	flag.Var(&spoofTargetFlags, "spoof-target", "Per-pattern spoof addresses pattern[,pattern...]=ip[,ip...] overriding -spoof-ip for those names, repeatable")
+	spoofTTL := flag.Duration("spoof-ttl", 60*time.Second, "TTL of spoofed answers unless a -rule sets one")
+	var ruleFlags stringList
+	flag.Var(&ruleFlags, "rule", "Per-pattern action pattern[,pattern...]=spoof[:ip,...]|forward|nxdomain|sinkhole|static:record[;record...], optionally with a TTL (spoof@300:ip), repeatable")
+	spoofCIDR := flag.String("spoof-cidr", "", "Comma-separated CIDRs: forwarded A/AAAA answers resolving into them are spoofed and the proxy accepts their hosts")
+	spoofCIDRFile := flag.String("spoof-cidr-file", "", "File with CIDRs like -spoof-cidr, one or more per line (e.g., the prefixes of an ASN)")
+	upstreamDNS := flag.String("upstream-dns", strings.Join(defaultUpstreamDNS, ","), "Comma-separated list of upstream DNS servers (host:port, tls://host[:port] or https://host/dns-query)")
+	var forwardZones stringList
+	flag.Var(&forwardZones, "forward-zone", "Conditional forwarding rule suffix=upstream[,upstream...] (suffix may be a CIDR for reverse zones), repeatable")
+	upstreamStrategy := flag.String("upstream-strategy", dns.StrategySequential, "Upstream selection strategy: sequential, parallel, fastest or round-robin")
+	cacheSize := flag.Int("cache-size", 10000, "Maximum number of cached upstream DNS responses (0 disables caching)")
+	minTTL := flag.Duration("min-ttl", 0, "Lower bound for TTLs of upstream answers (0 keeps upstream TTLs)")
+	maxTTL := flag.Duration("max-ttl", 0, "Upper bound for TTLs of upstream answers (0 keeps upstream TTLs)")
+	serveStale := flag.Duration("serve-stale", 24*time.Hour, "How long expired cache entries may be served when upstreams fail (0 disables)")
+	prefetchHits := flag.Int("prefetch-hits", 3, "Refresh cache entries queried this many times shortly before they expire (0 disables)")
+	aclDeny := flag.String("acl-deny", "", "Comma-separated client CIDRs that are always refused")
+	aclSpoof := flag.String("acl-spoof", "", "Comma-separated client CIDRs that get spoofed answers (if -acl-spoof or -acl-forward is set, unlisted clients are refused)")
+	aclForward := flag.String("acl-forward", "", "Comma-separated client CIDRs that only get plain forwarding, no spoofing")
+	clientQPS := flag.Float64("client-qps", 0, "Queries per second allowed per client /24 (IPv4) or /56 (IPv6), 0 disables")
+	clientBurst := flag.Int("client-burst", 100, "Queries a client prefix may send at once above -client-qps")
+	rrlRate := flag.Float64("rrl-rate", 20, "Identical UDP responses per second per client prefix (response rate limiting), 0 disables")
+	rrlSlip := flag.Int("rrl-slip", 2, "Every Nth rate-limited response is sent truncated so real clients retry over TCP (0 never)")
+	ecsPolicy := flag.String("ecs", dns.ECSStrip, "EDNS Client Subnet on forwarded queries: strip, pass or replace (always stripped for spoofed names)")
+	ecsSubnet := flag.String("ecs-subnet", "", "Subnet sent upstream with -ecs=replace (default: /24 of the first IPv4 spoof IP)")
+	httpsRecords := flag.String("https-rr", dns.HTTPSNoData, "HTTPS/SVCB answers for spoofed names: nodata, or rewrite (upstream records without ECH/h3, hints set to the spoof IPs)")
+	dnssec := flag.Bool("dnssec", false, "Validate forwarded answers (except spoofed names) from the built-in root trust anchor: AD if secure, SERVFAIL if bogus")
+	blockDoH := flag.Bool("block-doh", false, "Make browsers fall back to this resolver: NXDOMAIN for DoH/Private Relay canaries, sinkhole public DoH/DoT resolvers")
+	blockDoHFile := flag.String("block-doh-file", "", "File with more DoH/DoT resolver names for -block-doh (hosts or adblock format, @@ exceptions keep built-in ones)")
+	var rpzFlags stringList
+	flag.Var(&rpzFlags, "rpz", "Response policy zone file (QNAME and rpz-ip triggers), repeatable, earlier zones win")
+	var blocklistFlags stringList
+	flag.Var(&blocklistFlags, "blocklist", "Blocklist file [name=]path in hosts or adblock (||domain^) format, repeatable")
+	blocklistDisable := flag.String("blocklist-disable", "", "Comma-separated names of blocklists to load but not apply")
+	blocklistAllow := flag.String("blocklist-allow", "", "Comma-separated name patterns never blocked by any blocklist")
+	blocklistAction := flag.String("blocklist-action", dns.ActionNXDomain, "Answer for blocked names: nxdomain or sinkhole (0.0.0.0 and ::)")
+	resolverDNS := flag.String("resolver-dns", "8.8.8.8:53", "DNS server for proxy to resolve backend hosts and DoT/DoH upstream hostnames (to avoid loops)")
 
 	flag.Parse()
 
-	// Parse spoof IP
-	ip := net.ParseIP(*spoofIP)
-	if ip == nil {
+	if (*dotPort != "" || *dohPort != "") && (*tlsCert == "" || *tlsKey == "") {
+		log.Fatalf("-dot-port and -doh-port require -tls-cert and -tls-key")
+	}
+
+	// Parse spoof IPs; -spoof-ipv4/-spoof-ipv6 replace the addresses of their family
+	ips, err := dns.ParseIPs(*spoofIP)
+	if err != nil || len(ips) == 0 {
 		log.Fatalf("Invalid spoof IP: %s", *spoofIP)
 	}
+	ipv4s := parseFamily(*spoofIPv4, true)
+	ipv6s := parseFamily(*spoofIPv6, false)
+
+	if *spoofTTL < time.Second {
+		log.Fatalf("Invalid -spoof-ttl: %s, must be at least 1s", *spoofTTL)
+	}
+	if *minTTL < 0 || *maxTTL < 0 || (*maxTTL > 0 && *minTTL > *maxTTL) {
+		log.Fatalf("Invalid -min-ttl/-max-ttl: %s/%s", *minTTL, *maxTTL)
+	}
+
+	// Parse spoof patterns (suffixes, exact names, globs, regexps and exceptions)
+	suffixes := match.SplitList(*spoofSuffixes)
+	for _, pattern := range suffixes {
+		if _, err := match.Parse(pattern); err != nil {
+			log.Fatalf("Invalid -spoof-suffixes: %v", err)
+		}
+	}
+
+	// Parse per-pattern spoof targets
+	var spoofTargets []dns.SpoofTarget
+	for _, v := range spoofTargetFlags {
+		target, err := dns.ParseSpoofTarget(v)
+		if err != nil {
+			log.Fatalf("Invalid -spoof-target: %v", err)
+		}
+		for _, pattern := range target.Suffixes {
+			if _, err := match.Parse(pattern); err != nil {
+				log.Fatalf("Invalid -spoof-target: %v", err)
+			}
+		}
+		spoofTargets = append(spoofTargets, target)
+	}
+
+	// Parse spoofed networks
+	spoofNets, err := dns.ParseCIDRs(*spoofCIDR)
+	if err != nil {
+		log.Fatalf("Invalid -spoof-cidr: %v", err)
+	}
+	if *spoofCIDRFile != "" {
+		fileNets, err := dns.LoadCIDRs(*spoofCIDRFile)
+		if err != nil {
+			log.Fatalf("Invalid -spoof-cidr-file: %v", err)
+		}
+		spoofNets = append(spoofNets, fileNets...)
+	}
+
+	// Parse per-pattern actions
+	var rules []dns.Rule
+	for _, v := range ruleFlags {
+		rule, err := dns.ParseRule(v)
+		if err != nil {
+			log.Fatalf("Invalid -rule: %v", err)
+		}
+		rules = append(rules, rule)
+	}
+
+	if *httpsRecords != dns.HTTPSNoData && *httpsRecords != dns.HTTPSRewrite {
+		log.Fatalf("Invalid -https-rr: %s", *httpsRecords)
+	}
+
+	// Load extra DoH resolver names; exceptions keep built-in resolvers working
+	var dohResolvers []string
+	if *blockDoHFile != "" {
+		list, err := dns.LoadBlocklist(*blockDoHFile)
+		if err != nil {
+			log.Fatalf("Invalid -block-doh-file: %v", err)
+		}
+		dohResolvers = list.Block
+		for _, pattern := range list.Allow {
+			dohResolvers = append(dohResolvers, "!"+pattern)
+		}
+	}
+
+	// Load response policy zones
+	var rpzZones []dns.RPZ
+	for _, path := range rpzFlags {
+		zone, err := dns.LoadRPZ(path)
+		if err != nil {
+			log.Fatalf("Invalid -rpz: %v", err)
+		}
+		rpzZones = append(rpzZones, zone)
+	}
 
-	// Parse suffixes
-	suffixes := strings.Split(*spoofSuffixes, ",")
-	for i := range suffixes {
-		suffixes[i] = strings.TrimSpace(suffixes[i])
+	// Load blocklists
+	if *blocklistAction != dns.ActionNXDomain && *blocklistAction != dns.ActionSinkhole {
+		log.Fatalf("Invalid -blocklist-action: %s", *blocklistAction)
+	}
+	disabledLists := make(map[string]bool)
+	for _, name := range strings.Split(*blocklistDisable, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			disabledLists[name] = true
+		}
+	}
+	var blocklists []dns.Blocklist
+	for _, v := range blocklistFlags {
+		list, err := dns.LoadBlocklist(v)
+		if err != nil {
+			log.Fatalf("Invalid -blocklist: %v", err)
+		}
+		list.Disabled = disabledLists[list.Name]
+		delete(disabledLists, list.Name)
+		blocklists = append(blocklists, list)
+	}
+	for name := range disabledLists {
+		log.Fatalf("Invalid -blocklist-disable: no blocklist named %s", name)
+	}
+	var allowPatterns []string
+	for _, pattern := range match.SplitList(*blocklistAllow) {
+		if _, err := match.Parse(pattern); err != nil {
+			log.Fatalf("Invalid -blocklist-allow: %v", err)
+		}
+		allowPatterns = append(allowPatterns, pattern)
 	}
 
 	// Parse upstream DNS
@@ -90,24 +268,164 @@ func main() {
 		upstreams[i] = strings.TrimSpace(upstreams[i])
 	}
 
+	// Parse conditional forwarding rules
+	var forwardRules []dns.ForwardRule
+	for _, zone := range forwardZones {
+		rule, err := dns.ParseForwardRule(zone)
+		if err != nil {
+			log.Fatalf("Invalid -forward-zone: %v", err)
+		}
+		forwardRules = append(forwardRules, rule)
+	}
+
+	// Parse client access lists
+	denyClients, err := dns.ParseCIDRs(*aclDeny)
+	if err != nil {
+		log.Fatalf("Invalid -acl-deny: %v", err)
+	}
+	spoofClients, err := dns.ParseCIDRs(*aclSpoof)
+	if err != nil {
+		log.Fatalf("Invalid -acl-spoof: %v", err)
+	}
+	forwardClients, err := dns.ParseCIDRs(*aclForward)
+	if err != nil {
+		log.Fatalf("Invalid -acl-forward: %v", err)
+	}
+
+	// Parse ECS replacement subnet, defaulting to our own /24
+	var ecsNet *net.IPNet
+	if *ecsPolicy == dns.ECSReplace {
+		if *ecsSubnet != "" {
+			if _, ecsNet, err = net.ParseCIDR(*ecsSubnet); err != nil {
+				log.Fatalf("Invalid -ecs-subnet: %v", err)
+			}
+		} else {
+			for _, ip := range append(ipv4s, ips...) {
+				if ip4 := ip.To4(); ip4 != nil {
+					ecsNet = &net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}
+					break
+				}
+			}
+			if ecsNet == nil {
+				log.Fatalf("-ecs=replace requires -ecs-subnet when there is no IPv4 spoof IP")
+			}
+		}
+	}
+
 	log.Println("=== DNS Spoofer + Proxy ===")
-	log.Printf("Spoof IP: %s", ip)
-	log.Printf("Spoof suffixes: %v", suffixes)
-	log.Printf("DNS listen: %s", *dnsPort)
+	log.Printf("Spoof IP: %v", ips)
+	if len(ipv4s) > 0 || len(ipv6s) > 0 {
+		log.Printf("Spoof IPv4: %v, IPv6: %v (replacing -spoof-ip of the same family)", ipv4s, ipv6s)
+	}
+	log.Printf("Spoof suffixes: %v (TTL %s)", suffixes, *spoofTTL)
+	for _, target := range spoofTargets {
+		log.Printf("Spoof target: %v -> %v", target.Suffixes, target.IPs)
+	}
+	if len(spoofNets) > 0 {
+		log.Printf("Spoof networks: %d (%v)", len(spoofNets), spoofNets[:min(len(spoofNets), 10)])
+	}
+	for _, rule := range rules {
+		if rule.TTL > 0 {
+			log.Printf("Rule TTL: %v -> %s", rule.Patterns, rule.TTL)
+		}
+		switch {
+		case len(rule.IPs) > 0:
+			log.Printf("Rule: %v -> %s %v", rule.Patterns, rule.Action, rule.IPs)
+		case len(rule.Records) > 0:
+			log.Printf("Rule: %v -> %s %q", rule.Patterns, rule.Action, rule.Records)
+		default:
+			log.Printf("Rule: %v -> %s", rule.Patterns, rule.Action)
+		}
+	}
+	if *blockDoH {
+		log.Printf("DoH countermeasures: on (%d extra resolver patterns)", len(dohResolvers))
+	}
+	for _, zone := range rpzZones {
+		log.Printf("RPZ: %s (%s) %d triggers", zone.Name, zone.Path, len(zone.Policies))
+	}
+	for _, list := range blocklists {
+		log.Printf("Blocklist: %s (%s) %d entries, %d exceptions, enabled %v", list.Name, list.Path, len(list.Block), len(list.Allow), !list.Disabled)
+	}
+	if len(blocklists) > 0 {
+		log.Printf("Blocklist action: %s, allowlist %v", *blocklistAction, allowPatterns)
+	}
+	log.Printf("DNS listen: %s (UDP/TCP)", *dnsPort)
+	if *dotPort != "" {
+		log.Printf("DoT listen: %s", *dotPort)
+	}
+	if *dohPort != "" {
+		log.Printf("DoH listen: %s/dns-query", *dohPort)
+	}
 	log.Printf("HTTP listen: %s", *httpPort)
 	log.Printf("HTTPS listen: %s", *httpsPort)
 	log.Printf("UDP sink listen: %s (QUIC/HTTP3 drop)", *udpSinkPort)
-	log.Printf("Upstream DNS: %v", upstreams)
+	log.Printf("Upstream DNS: %v (%s)", upstreams, *upstreamStrategy)
+	for _, rule := range forwardRules {
+		log.Printf("Forward zone: %s -> %v", rule.Suffix, rule.Upstreams)
+	}
+	if len(denyClients)+len(spoofClients)+len(forwardClients) > 0 {
+		log.Printf("Client ACL: deny %v, spoof %v, forward %v", denyClients, spoofClients, forwardClients)
+	} else {
+		log.Printf("Client ACL: none (open resolver)")
+	}
+	log.Printf("Rate limits: %.0f qps per client (burst %d), RRL %.0f rps (slip %d)", *clientQPS, *clientBurst, *rrlRate, *rrlSlip)
+	if ecsNet != nil {
+		log.Printf("ECS: %s (%s)", *ecsPolicy, ecsNet)
+	} else {
+		log.Printf("ECS: %s", *ecsPolicy)
+	}
+	log.Printf("HTTPS/SVCB for spoofed names: %s", *httpsRecords)
+	log.Printf("DNSSEC validation: %v", *dnssec)
 	log.Printf("Resolver DNS: %s", *resolverDNS)
+	log.Printf("DNS cache size: %d (serve-stale %s, prefetch after %d hits)", *cacheSize, *serveStale, *prefetchHits)
+	if *minTTL > 0 || *maxTTL > 0 {
+		log.Printf("Upstream TTL clamp: min %s, max %s", *minTTL, *maxTTL)
+	}
 	log.Println("===========================")
 
 	// Create and start DNS server
 	dnsServer := dns.New(dns.Config{
-		ListenAddr:      *dnsPort,
-		SpoofIP:         ip,
-		SpoofSuffixes:   suffixes,
-		UpstreamDNS:     upstreams,
-		UpstreamTimeout: 5 * time.Second,
+		ListenAddr:       *dnsPort,
+		SpoofIPs:         ips,
+		SpoofIPv4:        ipv4s,
+		SpoofIPv6:        ipv6s,
+		SpoofSuffixes:    suffixes,
+		SpoofTargets:     spoofTargets,
+		Rules:            rules,
+		SpoofNetworks:    spoofNets,
+		SpoofTTL:         *spoofTTL,
+		UpstreamDNS:      upstreams,
+		UpstreamTimeout:  5 * time.Second,
+		UpstreamStrategy: *upstreamStrategy,
+		ForwardRules:     forwardRules,
+		TCPIdleTimeout:   *dnsTCPIdle,
+		DoTListenAddr:    *dotPort,
+		DoHListenAddr:    *dohPort,
+		TLSCertFile:      *tlsCert,
+		TLSKeyFile:       *tlsKey,
+		BootstrapDNS:     *resolverDNS,
+		CacheSize:        *cacheSize,
+		ServeStale:       *serveStale,
+		MinTTL:           *minTTL,
+		MaxTTL:           *maxTTL,
+		PrefetchHits:     *prefetchHits,
+		DenyClients:      denyClients,
+		SpoofClients:     spoofClients,
+		ForwardClients:   forwardClients,
+		ClientQueryRate:  *clientQPS,
+		ClientQueryBurst: *clientBurst,
+		RRLRate:          *rrlRate,
+		RRLSlip:          *rrlSlip,
+		ECSPolicy:        *ecsPolicy,
+		ECSSubnet:        ecsNet,
+		HTTPSRecords:     *httpsRecords,
+		DNSSEC:           *dnssec,
+		BlockDoH:         *blockDoH,
+		DoHResolvers:     dohResolvers,
+		RPZ:              rpzZones,
+		Blocklists:       blocklists,
+		BlocklistAllow:   allowPatterns,
+		BlocklistAction:  *blocklistAction,
 	})
 
 	if err := dnsServer.Start(); err != nil {
@@ -118,7 +436,8 @@ func main() {
 	proxyServer := proxy.New(proxy.Config{
 		HTTPAddr:        *httpPort,
 		HTTPSAddr:       *httpsPort,
-		AllowedSuffixes: suffixes,
+		Allowed:         dnsServer.ProxyTarget, // Proxy exactly the names the DNS spoofs
+		AllowedNetworks: spoofNets,             // and the hosts it spoofs by address
 		ResolverDNS:     *resolverDNS,
 		DialTimeout:     5 * time.Second,
 		PeekTimeout:     5 * time.Second,
@@ -164,6 +483,9 @@ func main() {
 		log.Printf("UDP sink shutdown error: %v", err)
 		shutdownErr = err
 	}
+	for _, stats := range dnsServer.BlocklistStats() {
+		log.Printf("Blocklist %s: %d queries blocked", stats.Name, stats.Blocked)
+	}
 
 	if shutdownErr != nil {
 		log.Println("Shutdown completed with errors")